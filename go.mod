@@ -5,6 +5,7 @@ go 1.21
 require (
 	github.com/cespare/xxhash/v2 v2.3.0
 	github.com/go-sql-driver/mysql v1.8.1
+	golang.org/x/text v0.14.0
 )
 
 require filippo.io/edwards25519 v1.1.0 // indirect
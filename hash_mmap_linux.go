@@ -0,0 +1,33 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// hashFileMmap hashes the first hashLimit bytes of f through a read-only
+// memory mapping. It returns false if the file could not be mapped, in which
+// case the caller falls back to streaming.
+func hashFileMmap(f *os.File, size int64) (uint64, bool) {
+	if size == 0 {
+		// Zero-length mappings are not allowed
+		return 0, false
+	}
+
+	length := size
+	if length > hashLimit {
+		length = hashLimit
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(length), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return 0, false
+	}
+	defer syscall.Munmap(data)
+
+	return xxhash.Sum64(data), true
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// hashFileMmap is not supported on this platform, files are always streamed
+func hashFileMmap(f *os.File, size int64) (uint64, bool) {
+	return 0, false
+}
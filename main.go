@@ -1,52 +1,243 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"math"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"text/tabwriter"
 	"time"
-	"unicode"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/cespare/xxhash/v2"
+	"golang.org/x/text/unicode/norm"
+)
+
+// stdout and stderr receive all output, --log-file adds a copy of both
+var (
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
 )
 
 type Config struct {
 	DBHost         string
 	DBPort         string
+	DBSocket       string
 	DBName         string
 	DBUser         string
 	DBPass         string
+	DBDSN          string
 	DBTablePrefix  string
 	MediaPath      string
 	WorkerCount    int
+	WalkerCount    int
+	HashWorkers    int
+	MaxDepth       int
+	MaxFilesPerDir int
+	HashStrategy   string
+	MmapThreshold  int64
+	OnlyPathPrefix string
+	DedupStrategy  string
+	DBReadTimeout  time.Duration
+	DBWriteTimeout time.Duration
+	DBTimezone     string
+	IgnoreErrors   bool
+	MaxUnusedRatio int
+	MaxRemoveBytes int64
+	UniqueBy       string
+	NoHash         bool
+	MinAge         time.Duration
+	DBInitStmts    []string
+	DBInitMagento  bool
+	DBMaxPacket    int64
+	DBCollation    string
+
+	// Stop all cleanup at the first failed query or directory scan too,
+	// not only at failed file operations
+	ExitOnFirstError bool
+
+	// Compare the first bytes of every image with its extension
+	CheckImageHeaders bool
+
+	// Files below this path or glob pattern are skipped by the scan
+	WatermarkPath string
 }
 
 type FileInfo struct {
-	RelativePath string
-	Hash         uint64
-	Size         int64
+	RelativePath string    `json:"path"`
+	Hash         uint64    `json:"-"`
+	Size         int64     `json:"size"`
+	ModTime      time.Time `json:"mod_time"`
 }
 
 type Stats struct {
 	TotalFiles        int64
+	HashedFiles       int64
 	CachedFiles       int64
+	MetadataFiles     int64
 	UnusedFiles       int64
 	MissingFiles      int64
 	DuplicateFiles    int64
 	RemovedUnused     int64
 	RemovedDuplicates int64
 	RemovedOrphans    int64
+	RemovedMetadata   int64
 	BytesFreed        int64
 	UpdatedVarchar    int64
 	UpdatedGallery    int64
+	FailedOperations  int64
+	FailedRemovals    int64
+	InBothTables      int64
+	VarcharOnly       int64
+	GalleryOnly       int64
+	RemainingUnused   int64
+	NullGalleryValues int64
+	SwatchFiles       int64
+	UnusedSwatches    int64
+	RemovedSwatches   int64
+	MismatchedHeaders int64
+	WatermarkFiles    int64
+	DistinctHashes    int64
+	FixedPathEncoding int64
+	OvercrowdedDirs   int64
+	SkippedUnwritable int64
+
+	// Files in pub/media/customer and pub/media/import
+	CustomerFiles        int64
+	UnusedCustomerFiles  int64
+	RemovedCustomerFiles int64
+	ImportFiles          int64
+	UnusedImportFiles    int64
+	RemovedImportFiles   int64
+
+	// Resized images in cache/ whose source image is gone
+	OrphanCacheFiles   int64
+	RemovedOrphanCache int64
+
+	// Rows changed by the --fix-* operations
+	InsertedGallery      int64
+	MissingGalleryRows   int64
+	ReorderedGalleryRows int64
+	RemovedNullGallery   int64
+	EmptyGalleryValues   int64
+	RemovedEmptyGallery  int64
+	DanglingLinks        int64
+	RemovedDanglingLinks int64
+
+	// Gallery values only assigned in a store view other than admin (0)
+	StoreSpecificImages int64
+
+	// Images stored in several size variants, with --detect-split-images
+	SplitImageGroups int64
+
+	// Video gallery entries by the kind of video URL, with --report-video-entries
+	ExternalVideoEntries int64
+	LocalVideoEntries    int64
+
+	// Highest heap in use sampled during the scan, with --track-memory
+	PeakMemory int64
+
+	// Set by Run before the summary is written
+	GalleryEntries int
+	ScanDuration   time.Duration
+	DBDuration     time.Duration
+	TotalDuration  time.Duration
+
+	// Wall clock time per step, printed with --verbose and always part of
+	// the json stats. timingNames keeps the order the steps were added in.
+	OperationTimings map[string]time.Duration
+	timingNames      []string
+
+	// Time spent by all workers combined, in nanoseconds
+	StatNanos   int64
+	HashNanos   int64
+	HashedBytes int64
+}
+
+// ScanResult holds everything collected by scanFilesystem
+type ScanResult struct {
+	FilesMap map[string]FileInfo
+	HashMap  map[dedupeKey][]FileInfo
+	SizeMap  map[int64][]string
+
+	// MetadataFiles lists OS metadata files relative to the media path
+	MetadataFiles []string
+
+	// MismatchFiles lists images whose content does not match their
+	// extension, only filled with --check-image-headers
+	MismatchFiles []string
+
+	// OvercrowdedDirs holds the number of files of every directory above
+	// --max-files-per-dir, keyed by its path relative to the media path
+	OvercrowdedDirs map[string]int
+
+	// Stopped is set when a directory could not be read and
+	// fileOperationFailed stopped the scan, the result is incomplete
+	Stopped bool
+}
+
+// dedupeKey groups duplicate files. Depending on --compute-unique-by only
+// Hash, only Name (the base name) or both are set. With --no-hash files are
+// grouped by Name and Size instead.
+type dedupeKey struct {
+	Hash uint64
+	Name string
+	Size int64
+}
+
+func (k dedupeKey) String() string {
+	switch {
+	case k.Size != 0:
+		return fmt.Sprintf("Name %s, size %d", k.Name, k.Size)
+	case k.Name == "":
+		return fmt.Sprintf("Hash %016x", k.Hash)
+	case k.Hash == 0:
+		return fmt.Sprintf("Name %s", k.Name)
+	default:
+		return fmt.Sprintf("Hash %016x, name %s", k.Hash, k.Name)
+	}
+}
+
+// newDedupeKey returns the duplicate group key of a file for --compute-unique-by
+func newDedupeKey(uniqueBy string, fileInfo FileInfo) dedupeKey {
+	switch uniqueBy {
+	case "name-size":
+		return dedupeKey{Name: filepath.Base(fileInfo.RelativePath), Size: fileInfo.Size}
+	case "path":
+		return dedupeKey{Name: filepath.Base(fileInfo.RelativePath)}
+	case "both":
+		return dedupeKey{Hash: fileInfo.Hash, Name: filepath.Base(fileInfo.RelativePath)}
+	default:
+		return dedupeKey{Hash: fileInfo.Hash}
+	}
+}
+
+// DBConn holds the connections to the catalog database. DB receives all
+// INSERT/UPDATE/DELETE statements, ReadDB all SELECT queries. ReadDB is a
+// read replica with --db-read-host and the same as DB otherwise.
+type DBConn struct {
+	DB     *sql.DB
+	ReadDB *sql.DB
 }
 
 type DuplicateMapping struct {
@@ -57,62 +248,398 @@ type DuplicateMapping struct {
 }
 
 func main() {
+	os.Exit(Run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// Run parses args, executes the requested operations and returns the process
+// exit code. All output is written to stdout and stderr.
+func Run(args []string, out, errOut io.Writer) int {
+	stdout, stderr = out, errOut
+	printSQL = false
+
+	fs := flag.NewFlagSet("magento2-media-cleaner", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
 	// Custom usage function to show double dashes for long flags
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Operation flags:\n")
-		fmt.Fprintf(os.Stderr, "  -u, --list-unused         List unused media files\n")
-		fmt.Fprintf(os.Stderr, "  -m, --list-missing        List missing media files\n")
-		fmt.Fprintf(os.Stderr, "  -d, --list-duplicates     List duplicated files\n")
-		fmt.Fprintf(os.Stderr, "  -r, --remove-unused       Remove unused product images\n")
-		fmt.Fprintf(os.Stderr, "  -o, --remove-orphans      Remove orphaned media gallery rows\n")
-		fmt.Fprintf(os.Stderr, "  -x, --remove-duplicates   Remove duplicated files and update database\n")
-		fmt.Fprintf(os.Stderr, "\nConfiguration flags:\n")
-		fmt.Fprintf(os.Stderr, "  --magento-root string     Path to Magento root directory (optional, auto-detects)\n")
-		fmt.Fprintf(os.Stderr, "  --db-host string          Database host (default: localhost)\n")
-		fmt.Fprintf(os.Stderr, "  --db-port string          Database port (default: 3306)\n")
-		fmt.Fprintf(os.Stderr, "  --db-name string          Database name\n")
-		fmt.Fprintf(os.Stderr, "  --db-user string          Database user\n")
-		fmt.Fprintf(os.Stderr, "  --db-pass string          Database password\n")
-		fmt.Fprintf(os.Stderr, "  --db-prefix string        Database table prefix\n")
-		fmt.Fprintf(os.Stderr, "  --media-path string       Path to pub/media/catalog/product\n")
-		fmt.Fprintf(os.Stderr, "  --workers int             Number of parallel workers (default: 10)\n")
-		fmt.Fprintf(os.Stderr, "\nNote: Configuration values are read from app/etc/env.php if not provided\n")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s [options]\n\n", fs.Name())
+		fmt.Fprintf(stderr, "Operation flags:\n")
+		fmt.Fprintf(stderr, "  -u, --list-unused         List unused media files\n")
+		fmt.Fprintf(stderr, "  -m, --list-missing        List missing media files\n")
+		fmt.Fprintf(stderr, "      --list-missing-formatted\n")
+		fmt.Fprintf(stderr, "                            Print image resize commands for the products with missing files\n")
+		fmt.Fprintf(stderr, "  -d, --list-duplicates     List duplicated files\n")
+		fmt.Fprintf(stderr, "  -r, --remove-unused       Remove unused product images\n")
+		fmt.Fprintf(stderr, "  -o, --remove-orphans      Remove orphaned media gallery rows\n")
+		fmt.Fprintf(stderr, "  -x, --remove-duplicates   Remove duplicated files and update database\n")
+		fmt.Fprintf(stderr, "  -a, --all                 List unused, missing and duplicated files (same as -u -m -d)\n")
+		fmt.Fprintf(stderr, "      --list-metadata-files List OS metadata files (.DS_Store, Thumbs.db, ...)\n")
+		fmt.Fprintf(stderr, "      --remove-metadata-files\n")
+		fmt.Fprintf(stderr, "                            Remove OS metadata files\n")
+		fmt.Fprintf(stderr, "      --list-cached-only    List cached images whose source image no longer exists\n")
+		fmt.Fprintf(stderr, "      --remove-cached-only  Remove cached images whose source image no longer exists\n")
+		fmt.Fprintf(stderr, "      --fix-varchar-only    Add gallery rows for existing images only referenced by image attributes\n")
+		fmt.Fprintf(stderr, "      --import-duplicates-map path\n")
+		fmt.Fprintf(stderr, "                            Use the duplicates of an exported map instead of scanning, for -d and -x\n")
+		fmt.Fprintf(stderr, "      --fix-varchar-without-gallery\n")
+		fmt.Fprintf(stderr, "                            Add gallery rows for product image roles missing from their gallery\n")
+		fmt.Fprintf(stderr, "      --remove-dangling-links\n")
+		fmt.Fprintf(stderr, "                            Delete gallery links to products that no longer exist\n")
+		fmt.Fprintf(stderr, "      --fix-path-encoding   Rename files to their Unicode NFC path and update the database\n")
+		fmt.Fprintf(stderr, "      --fix-null-gallery-values\n")
+		fmt.Fprintf(stderr, "                            Delete media gallery rows with a NULL value\n")
+		fmt.Fprintf(stderr, "      --remove-empty-gallery-values\n")
+		fmt.Fprintf(stderr, "                            Delete media gallery rows with an empty value\n")
+		fmt.Fprintf(stderr, "      --fix-gallery-ordering\n")
+		fmt.Fprintf(stderr, "                            Renumber gallery positions per product and store view without gaps\n")
+		fmt.Fprintf(stderr, "      --include-swatch-images\n")
+		fmt.Fprintf(stderr, "                            Also check pub/media/attribute/swatch, -u lists and -r removes unused swatches\n")
+		fmt.Fprintf(stderr, "      --include-customer-upload\n")
+		fmt.Fprintf(stderr, "                            Also check pub/media/customer and pub/media/import the same way\n")
+		fmt.Fprintf(stderr, "\nReport flags:\n")
+		fmt.Fprintf(stderr, "      --export-duplicates-map path\n")
+		fmt.Fprintf(stderr, "                            Write the duplicate groups to a JSON file and exit (no database needed)\n")
+		fmt.Fprintf(stderr, "      --per-attribute-stats Show referenced and missing images per image attribute\n")
+		fmt.Fprintf(stderr, "      --list-products-unused-image-roles\n")
+		fmt.Fprintf(stderr, "                            List products whose image roles all point to missing files\n")
+		fmt.Fprintf(stderr, "      --report-file-age-distribution\n")
+		fmt.Fprintf(stderr, "                            Group files and unused files by modification age\n")
+		fmt.Fprintf(stderr, "      --find-multi-product-duplicates\n")
+		fmt.Fprintf(stderr, "                            Report duplicate groups whose files belong to different products\n")
+		fmt.Fprintf(stderr, "      --report-mime-distribution\n")
+		fmt.Fprintf(stderr, "                            Show files and size per detected content type and extension\n")
+		fmt.Fprintf(stderr, "      --report-path-encoding-issues\n")
+		fmt.Fprintf(stderr, "                            List files whose path is not Unicode NFC normalized\n")
+		fmt.Fprintf(stderr, "  --detect-split-images     List size variants of gallery images and keep them out of deduplication\n")
+		fmt.Fprintf(stderr, "      --compute-dedup-savings\n")
+		fmt.Fprintf(stderr, "                            Estimate duplicates from the gallery values without a scan and exit\n")
+		fmt.Fprintf(stderr, "      --count-distinct-hashes\n")
+		fmt.Fprintf(stderr, "                            Show the number of unique file contents in the summary\n")
+		fmt.Fprintf(stderr, "      --report-duplicate-count-histogram\n")
+		fmt.Fprintf(stderr, "                            Show the number of duplicate groups and wasted space per group size\n")
+		fmt.Fprintf(stderr, "      --report-product-image-count-stats\n")
+		fmt.Fprintf(stderr, "                            Show the number of products per image count range and product type\n")
+		fmt.Fprintf(stderr, "      --report-store-specific-images\n")
+		fmt.Fprintf(stderr, "                            List gallery images only assigned in a single store view\n")
+		fmt.Fprintf(stderr, "      --report-video-entries\n")
+		fmt.Fprintf(stderr, "                            Count video gallery entries with external and local video URLs\n")
+		fmt.Fprintf(stderr, "      --report-attribute-set-breakdown\n")
+		fmt.Fprintf(stderr, "                            Show gallery images, missing and unused files per attribute set\n")
+		fmt.Fprintf(stderr, "      --report-gallery-stats\n")
+		fmt.Fprintf(stderr, "                            Show entries per store view, images per product and disabled images\n")
+		fmt.Fprintf(stderr, "      --report-import-candidates\n")
+		fmt.Fprintf(stderr, "                            List recent unused files matching --import-name-pattern (--import-age, default: 6h)\n")
+		fmt.Fprintf(stderr, "      --find-varchar-without-gallery\n")
+		fmt.Fprintf(stderr, "                            List product image roles whose image is not in the product's gallery\n")
+		fmt.Fprintf(stderr, "      --find-dangling-gallery-value-links\n")
+		fmt.Fprintf(stderr, "                            List gallery links to products that no longer exist\n")
+		fmt.Fprintf(stderr, "      --check-duplicate-products\n")
+		fmt.Fprintf(stderr, "                            Report products that share all their images with another product\n")
+		fmt.Fprintf(stderr, "      --report-top-N-largest-unused N\n")
+		fmt.Fprintf(stderr, "                            Print the N largest unused files (default: 10, 0 = off)\n")
+		fmt.Fprintf(stderr, "      --check-image-headers List images whose magic bytes do not match their extension\n")
+		fmt.Fprintf(stderr, "\nConfiguration flags:\n")
+		fmt.Fprintf(stderr, "  --magento-root string     Path to Magento root directory (optional, auto-detects)\n")
+		fmt.Fprintf(stderr, "  --db-host string          Database host (default: localhost)\n")
+		fmt.Fprintf(stderr, "  --db-port string          Database port (default: 3306)\n")
+		fmt.Fprintf(stderr, "  --db-name string          Database name\n")
+		fmt.Fprintf(stderr, "  --db-user string          Database user\n")
+		fmt.Fprintf(stderr, "  --db-pass string          Database password\n")
+		fmt.Fprintf(stderr, "  --db-max-packet size      Largest statement sent to MySQL, e.g. 128MB (default: driver default)\n")
+		fmt.Fprintf(stderr, "  --db-init-stmt string     SQL statement to run on every new connection (repeatable)\n")
+		fmt.Fprintf(stderr, "  --db-init-on-connect      Use Magento's session settings on every new connection\n")
+		fmt.Fprintf(stderr, "  --db-dsn string           MySQL DSN, replaces the other connection settings\n")
+		fmt.Fprintf(stderr, "  --connection-string-file path\n")
+		fmt.Fprintf(stderr, "                            Read the MySQL DSN from this file (e.g. a mounted secret)\n")
+		fmt.Fprintf(stderr, "  --db-prefix string        Database table prefix\n")
+		fmt.Fprintf(stderr, "  --split-db                Use the 'catalog' connection from env.php for catalog tables\n")
+		fmt.Fprintf(stderr, "  --db-role string          Connection of env.php to use (default: default)\n")
+		fmt.Fprintf(stderr, "  --db-read-host string     Read replica host for all SELECT queries (default: none)\n")
+		fmt.Fprintf(stderr, "  --db-read-port string     Read replica port (default: same as --db-port)\n")
+		fmt.Fprintf(stderr, "  --db-prefix-detection     Detect the table prefix from information_schema if env.php is unavailable\n")
+		fmt.Fprintf(stderr, "  --db-read-timeout duration  I/O read timeout for MySQL (e.g. 30s, default: none)\n")
+		fmt.Fprintf(stderr, "  --db-write-timeout duration I/O write timeout for MySQL (e.g. 60s, default: none)\n")
+		fmt.Fprintf(stderr, "  --db-collation string     Collation for path comparisons, e.g. utf8mb4_bin (default: column collation)\n")
+		fmt.Fprintf(stderr, "  --db-timezone string      Timezone for the MySQL session and parsed times (default: Local)\n")
+		fmt.Fprintf(stderr, "  --media-path string       Path to pub/media/catalog/product\n")
+		fmt.Fprintf(stderr, "  --workers int             Number of parallel workers (default: 10)\n")
+		fmt.Fprintf(stderr, "  --walker-workers int      Number of parallel directory walkers (default: 4)\n")
+		fmt.Fprintf(stderr, "  --hash-workers int        Number of parallel hashing workers (default: same as --workers)\n")
+		fmt.Fprintf(stderr, "  --parallel-hash-strategy string\n")
+		fmt.Fprintf(stderr, "                            concurrent, or sequential-dir to read one directory at a time on HDDs (default: concurrent)\n")
+		fmt.Fprintf(stderr, "  --mmap-threshold size     Memory-map files smaller than this for hashing, Linux only (default: 64MB, 0 disables)\n")
+		fmt.Fprintf(stderr, "  --max-depth int           Maximum directory depth to scan, 1 = media path only (default: 0, unlimited)\n")
+		fmt.Fprintf(stderr, "  --max-files-per-dir int   Warn about directories with more files than this (default: 0, no check)\n")
+		fmt.Fprintf(stderr, "  --generate-import-script string\n")
+		fmt.Fprintf(stderr, "                            Write a shell script that resizes images and reindexes modified products\n")
+		fmt.Fprintf(stderr, "  --only-path-prefix string Only scan and query paths below this prefix (e.g. /a/)\n")
+		fmt.Fprintf(stderr, "  --watermark-path string   Skip files below this directory or glob pattern (e.g. watermark)\n")
+		fmt.Fprintf(stderr, "  --dedup-strategy string   Which duplicate to keep: keep-largest, keep-smallest, keep-oldest, keep-newest\n")
+		fmt.Fprintf(stderr, "  --keep-N-duplicates int   Copies of each duplicate group kept by --remove-duplicates (default: 1)\n")
+		fmt.Fprintf(stderr, "  --remove-duplicates-batch-delay duration\n")
+		fmt.Fprintf(stderr, "                            Pause between the --remove-duplicates batches (e.g. 500ms)\n")
+		fmt.Fprintf(stderr, "  --compute-unique-by string\n")
+		fmt.Fprintf(stderr, "                            What makes files duplicates: hash, path (file name) or both (default: hash)\n")
+		fmt.Fprintf(stderr, "  --no-hash                 Skip hashing, duplicates are files with the same name and size\n")
+		fmt.Fprintf(stderr, "  --sort-duplicates-by-waste\n")
+		fmt.Fprintf(stderr, "                            Remove the duplicate groups that waste the most space first\n")
+		fmt.Fprintf(stderr, "  --exclude-products string Comma separated SKUs whose images are never removed\n")
+		fmt.Fprintf(stderr, "  --exclude-products-file string\n")
+		fmt.Fprintf(stderr, "                            File with SKUs (one per line) whose images are never removed\n")
+		fmt.Fprintf(stderr, "  --exclude-attribute-set string\n")
+		fmt.Fprintf(stderr, "                            Comma separated attribute set IDs whose product images are never removed\n")
+		fmt.Fprintf(stderr, "  --require-gallery-entry   Only count images in the gallery and an image attribute as used\n")
+		fmt.Fprintf(stderr, "  --include-only-products string\n")
+		fmt.Fprintf(stderr, "                            Comma separated SKUs, only their images count as used\n")
+		fmt.Fprintf(stderr, "  --gallery-image-threshold int\n")
+		fmt.Fprintf(stderr, "                            Count products with more images than this in --report-gallery-stats (default: 20)\n")
+		fmt.Fprintf(stderr, "  --verify-after-remove     Check that every removed file is really gone\n")
+		fmt.Fprintf(stderr, "  --check-writable          Skip files to remove in directories that fail a write test\n")
+		fmt.Fprintf(stderr, "  --ignore-errors           Log failed file operations and continue instead of stopping\n")
+		fmt.Fprintf(stderr, "  --exit-on-first-error     Also stop at the first failed query, batch update or directory scan\n")
+		fmt.Fprintf(stderr, "  --max-unused-ratio int    Refuse --remove-unused if more than this percentage of files is unused (default: 100)\n")
+		fmt.Fprintf(stderr, "  --max-remove-bytes size   Stop --remove-unused before freeing more than this (e.g. 10GB, default: 0, unlimited)\n")
+		fmt.Fprintf(stderr, "  --min-age duration        Never treat files modified less than this long ago as unused (e.g. 720h)\n")
+		fmt.Fprintf(stderr, "  --exclude-recently-modified age\n")
+		fmt.Fprintf(stderr, "                            Same as --min-age in days, weeks or months: 30d, 2w, 1m (0 = off)\n")
+		fmt.Fprintf(stderr, "  --format string           Output format of the file lists: text, table or ndjson (default: text)\n")
+		fmt.Fprintf(stderr, "  --count-only              Print only unused=N missing=N ... instead of the lists and summary\n")
+		fmt.Fprintf(stderr, "  --compact-unused-output   Only print the number and size of unused files per /x/y/ directory\n")
+		fmt.Fprintf(stderr, "  --stats-output string     Also write the summary to this file (.json, .csv or text)\n")
+		fmt.Fprintf(stderr, "  --report-format-version   Print the schema version of the JSON and CSV stats and exit\n")
+		fmt.Fprintf(stderr, "  --output-file string      Write the paths of --list-unused, --list-missing and --list-metadata-files to this file\n")
+		fmt.Fprintf(stderr, "  --output-separator string Separator written after each listed path, e.g. \\0 for xargs -0 (default: \\n)\n")
+		fmt.Fprintf(stderr, "\nDebug flags:\n")
+		fmt.Fprintf(stderr, "  --mock-db string          Use an in-memory mock database seeded with gallery paths from a file\n")
+		fmt.Fprintf(stderr, "  --fake-filesystem path    Read the files from path/manifest.json instead of scanning the media path\n")
+		fmt.Fprintf(stderr, "  --benchmark               Only scan the filesystem (no database) and report throughput\n")
+		fmt.Fprintf(stderr, "  --log-file string         Append all output to this file with timestamps\n")
+		fmt.Fprintf(stderr, "  --log-rotation string     Rotate the log file, \"<max-size> <max-age>\" (e.g. \"100MB 7d\")\n")
+		fmt.Fprintf(stderr, "  --track-memory            Sample heap usage during the scan and report the peak\n")
+		fmt.Fprintf(stderr, "  --max-memory size         Warn if the peak heap usage exceeds this (e.g. 2GB), implies --track-memory\n")
+		fmt.Fprintf(stderr, "  --print-sql               Print every SQL statement and its arguments to stderr\n")
+		fmt.Fprintf(stderr, "  --profile-cpu path        Write a pprof CPU profile of the scan (build with -tags profile)\n")
+		fmt.Fprintf(stderr, "  --profile-mem path        Write a pprof heap profile after the scan (build with -tags profile)\n")
+		fmt.Fprintf(stderr, "  --verbose                 Print the time spent on each step after the summary\n")
+		fmt.Fprintf(stderr, "  --log-level string        Log level: info or debug, debug implies --print-sql (default: info)\n")
+		fmt.Fprintf(stderr, "\nNote: Configuration values are read from app/etc/env.php if not provided\n")
 	}
 
 	// Operation flags with both short and long names
 	var listUnused, listMissing, listDupes, removeUnused, removeOrphans, removeDupes bool
+	var listMetadata, removeMetadata, fixVarcharOnly, fixGalleryOrdering, fixNullGalleryValues bool
+	var includeSwatches, includeCustomerUpload, removeDanglingLinks bool
+	var perAttributeStats, listBrokenRoleProducts, reportAges, findMultiProductDupes bool
+	var checkDuplicateProducts, reportGalleryStats, findDanglingLinks bool
+	var findVarcharWithoutGallery, fixVarcharWithoutGallery, reportImportCandidates bool
+	var removeEmptyGalleryValues, reportDuplicateHistogram, countDistinctHashes bool
+	var listCachedOnly, removeCachedOnly, reportPathEncoding, fixPathEncoding bool
+	var detectSplitImages, listMissingFormatted, reportVideoEntries bool
+	var reportImageCountStats, reportStoreSpecific, reportAttributeSets, reportMimeDistribution bool
+	var computeDedupSavings bool
+
+	fs.BoolVar(&listUnused, "list-unused", false, "List unused media files")
+	fs.BoolVar(&listUnused, "u", false, "List unused media files (shorthand)")
+
+	fs.BoolVar(&listMissing, "list-missing", false, "List missing media files")
+	fs.BoolVar(&listMissing, "m", false, "List missing media files (shorthand)")
+
+	fs.BoolVar(&listMissingFormatted, "list-missing-formatted", false, "Print bin/magento catalog:product:images:resize commands for the products with missing files")
+
+	fs.BoolVar(&listDupes, "list-duplicates", false, "List duplicated files")
+	fs.BoolVar(&listDupes, "d", false, "List duplicated files (shorthand)")
+
+	fs.BoolVar(&removeUnused, "remove-unused", false, "Remove unused product images")
+	fs.BoolVar(&removeUnused, "r", false, "Remove unused product images (shorthand)")
+
+	fs.BoolVar(&removeOrphans, "remove-orphans", false, "Remove orphaned media gallery rows")
+	fs.BoolVar(&removeOrphans, "o", false, "Remove orphaned media gallery rows (shorthand)")
+
+	fs.BoolVar(&removeDupes, "remove-duplicates", false, "Remove duplicated files and update database")
+	fs.BoolVar(&removeDupes, "x", false, "Remove duplicated files and update database (shorthand)")
+
+	var listAll bool
+	fs.BoolVar(&listAll, "all", false, "List unused, missing and duplicated files, same as -u -m -d")
+	fs.BoolVar(&listAll, "a", false, "List unused, missing and duplicated files (shorthand)")
+
+	fs.BoolVar(&listMetadata, "list-metadata-files", false, "List OS metadata files (.DS_Store, Thumbs.db, ...)")
+	fs.BoolVar(&removeMetadata, "remove-metadata-files", false, "Remove OS metadata files")
+	fs.BoolVar(&listCachedOnly, "list-cached-only", false, "List cached images whose source image no longer exists")
+	fs.BoolVar(&removeCachedOnly, "remove-cached-only", false, "Remove cached images whose source image no longer exists")
+	fs.BoolVar(&includeSwatches, "include-swatch-images", false, "Also check swatch images in pub/media/attribute/swatch, listed with --list-unused and removed with --remove-unused")
+	fs.BoolVar(&includeCustomerUpload, "include-customer-upload", false, "Also check customer uploads in pub/media/customer and import images in pub/media/import")
+	fs.BoolVar(&removeDanglingLinks, "remove-dangling-links", false, "Delete media gallery value_to_entity rows whose product no longer exists")
+	fs.BoolVar(&fixPathEncoding, "fix-path-encoding", false, "Rename files whose path is not in Unicode NFC form and update their gallery and attribute values")
+	fs.BoolVar(&fixNullGalleryValues, "fix-null-gallery-values", false, "Delete media gallery rows whose value is NULL")
+	fs.BoolVar(&removeEmptyGalleryValues, "remove-empty-gallery-values", false, "Delete media gallery rows whose value is an empty string")
+	fs.BoolVar(&fixGalleryOrdering, "fix-gallery-ordering", false, "Renumber media gallery positions per product and store view, after --remove-orphans")
+	fs.BoolVar(&fixVarcharOnly, "fix-varchar-only", false, "Insert media gallery rows for existing images that are only referenced by image attributes")
+
+	// Report flags
+	fs.BoolVar(&perAttributeStats, "per-attribute-stats", false, "Show referenced and missing images per image attribute")
+	fs.BoolVar(&listBrokenRoleProducts, "list-products-unused-image-roles", false, "List products whose image roles all point to missing files")
+	fs.BoolVar(&reportAges, "report-file-age-distribution", false, "Group files and unused files by modification age")
+	fs.BoolVar(&findMultiProductDupes, "find-multi-product-duplicates", false, "Report duplicate groups whose files belong to different products")
+	fs.BoolVar(&computeDedupSavings, "compute-dedup-savings", false, "Estimate the duplicates from the gallery values alone, without scanning, and exit")
+	fs.BoolVar(&countDistinctHashes, "count-distinct-hashes", false, "Show the number of unique file contents compared to the total number of files")
+	fs.BoolVar(&reportMimeDistribution, "report-mime-distribution", false, "Show the number and size of files per detected content type and extension")
+	fs.BoolVar(&reportPathEncoding, "report-path-encoding-issues", false, "List files whose path is not in Unicode NFC form, e.g. decomposed names uploaded from macOS")
+	fs.BoolVar(&detectSplitImages, "detect-split-images", false, "List gallery images stored in several size variants (e.g. product.jpg and product_small.jpg) and never remove them as duplicates")
+	fs.BoolVar(&reportDuplicateHistogram, "report-duplicate-count-histogram", false, "Show how many duplicate groups have 2, 3, ... files and the space they waste")
+	fs.BoolVar(&reportImageCountStats, "report-product-image-count-stats", false, "Show how many products have 0, 1, 2-5, 6-10, 11-20 and more than 20 images, per product type")
+	fs.BoolVar(&reportStoreSpecific, "report-store-specific-images", false, "List gallery images only assigned in a store view, not in the admin (store_id 0) scope")
+	fs.BoolVar(&reportVideoEntries, "report-video-entries", false, "Count the video gallery entries with an external (YouTube, Vimeo) and a local video URL")
+	fs.BoolVar(&reportAttributeSets, "report-attribute-set-breakdown", false, "Show gallery images, missing and unused files per product attribute set")
+	fs.BoolVar(&reportGalleryStats, "report-gallery-stats", false, "Show media gallery entries per store view, images per product and disabled images")
+	fs.BoolVar(&reportImportCandidates, "report-import-candidates", false, "List unused files that look like they belong to a running import")
+	importAge := fs.Duration("import-age", 6*time.Hour, "Unused files modified within this duration are import candidates, with --report-import-candidates")
+	importNamePattern := fs.String("import-name-pattern", `^[a-z0-9_-]+\.[a-z]+$`, "Regular expression the base name of an import candidate must match, with --report-import-candidates")
+	fs.BoolVar(&findVarcharWithoutGallery, "find-varchar-without-gallery", false, "List image role values of products that have no gallery row for that image")
+	fs.BoolVar(&fixVarcharWithoutGallery, "fix-varchar-without-gallery", false, "Insert the missing gallery rows found by --find-varchar-without-gallery for existing files")
+	fs.BoolVar(&findDanglingLinks, "find-dangling-gallery-value-links", false, "List media gallery value_to_entity rows whose product no longer exists")
+	fs.BoolVar(&checkDuplicateProducts, "check-duplicate-products", false, "Report products that share all their images with another product")
+
+	// Configuration flags
+	magentoRoot := fs.String("magento-root", "", "Path to Magento root directory (optional, auto-detects if not provided)")
+	dbHost := fs.String("db-host", "localhost", "Database host (optional, reads from app/etc/env.php if not provided)")
+	dbPort := fs.String("db-port", "3306", "Database port (optional, reads from app/etc/env.php if not provided)")
+	dbName := fs.String("db-name", "", "Database name (optional, reads from app/etc/env.php if not provided)")
+	dbUser := fs.String("db-user", "", "Database user (optional, reads from app/etc/env.php if not provided)")
+	dbPass := fs.String("db-pass", "", "Database password (optional, reads from app/etc/env.php if not provided)")
+	dbMaxPacket := fs.String("db-max-packet", "0", "Largest statement the MySQL client may send, e.g. 128MB (default: 0, the driver default of 64MB)")
+	var dbInitStmts stringList
+	fs.Var(&dbInitStmts, "db-init-stmt", "SQL statement to run on every new database connection, can be given more than once")
+	dbInitOnConnect := fs.Bool("db-init-on-connect", false, "Set the session variables Magento sets (SET NAMES utf8mb4, SQL_MODE) on every new database connection")
+	dbDSN := fs.String("db-dsn", "", "MySQL DSN (user:pass@tcp(host:port)/dbname), used instead of env.php and the other --db-* connection flags")
+	connectionStringFile := fs.String("connection-string-file", "", "Read the MySQL DSN from this file, e.g. a Kubernetes or Vault secret")
+	dbPrefix := fs.String("db-prefix", "", "Database table prefix (optional, reads from app/etc/env.php if not provided)")
+	splitDB := fs.Bool("split-db", false, "Use the 'catalog' connection from env.php for all catalog table queries (split database setups)")
+	dbRole := fs.String("db-role", "default", "Name of the connection in the 'db' section of env.php to use, e.g. indexer or checkout")
+	dbReadHost := fs.String("db-read-host", "", "Host of a read replica used for all SELECT queries, writes always go to the primary")
+	dbReadPort := fs.String("db-read-port", "", "Port of the read replica (default: same as the primary)")
+	prefixDetection := fs.Bool("db-prefix-detection", false, "Detect the table prefix from information_schema when it is not set and env.php could not be read")
+	dbReadTimeout := fs.Duration("db-read-timeout", 0, "I/O read timeout for the MySQL connection (e.g. 30s, 0 = none)")
+	dbWriteTimeout := fs.Duration("db-write-timeout", 0, "I/O write timeout for the MySQL connection (e.g. 60s, 0 = none)")
+	dbCollation := fs.String("db-collation", "", "Collation for comparing paths in the database, e.g. utf8mb4_bin for case-sensitive matching")
+	dbTimezone := fs.String("db-timezone", "Local", "Timezone for the MySQL session and parsed datetime values (e.g. UTC)")
+	mediaPath := fs.String("media-path", "", "Path to pub/media/catalog/product (optional, defaults to <magento_root>/pub/media/catalog/product)")
+	workers := fs.Int("workers", 10, "Number of parallel workers for file scanning")
+	walkerWorkers := fs.Int("walker-workers", 4, "Number of parallel directory walkers")
+	hashWorkers := fs.Int("hash-workers", 0, "Number of parallel hashing workers (default: same as --workers)")
+	hashStrategy := fs.String("parallel-hash-strategy", "concurrent", "How the workers read files: concurrent (SSD) or sequential-dir (one directory at a time, for HDDs)")
+	mmapThreshold := fs.String("mmap-threshold", "64MB", "Memory-map files smaller than this size for hashing on Linux (0 disables)")
+	maxDepth := fs.Int("max-depth", 0, "Maximum directory depth to scan, 1 = media path only (0 = unlimited)")
+	maxFilesPerDir := fs.Int("max-files-per-dir", 0, "Warn about directories with more files than this, e.g. 1000 (0 = no check)")
+	onlyPathPrefix := fs.String("only-path-prefix", "", "Only scan and query media paths below this prefix (e.g. /a/)")
+	importScript := fs.String("generate-import-script", "", "Write a shell script that resizes images and reindexes modified products")
+	dedupStrategy := fs.String("dedup-strategy", "", "Which duplicate to keep: keep-largest, keep-smallest, keep-oldest or keep-newest (default: first found)")
+	minAge := fs.Duration("min-age", 0, "Never treat files modified less than this long ago as unused, e.g. 720h")
+	excludeRecentlyModified := fs.String("exclude-recently-modified", "", "Same as --min-age in days, weeks or months: 30d, 2w or 1m (0 = no age filter)")
+	topLargestUnused := fs.Int("report-top-N-largest-unused", 10, "Print the N largest unused files with their sizes (0 = off)")
+	countOnly := fs.Bool("count-only", false, "Print only the counts as key=value pairs (or JSON with --format json) instead of the file lists and summary")
+	format := fs.String("format", "text", "Output format of --list-unused, --list-missing and --list-duplicates: text, table (aligned columns) or ndjson (one JSON object per file and the summary), json with --count-only")
+	compactUnused := fs.Bool("compact-unused-output", false, "Group --list-unused by the first two directory levels and only print counts and sizes")
+	reportFormatVersion := fs.Bool("report-format-version", false, "Print the schema version of the --stats-output JSON and CSV files and exit")
+	statsOutput := fs.String("stats-output", "", "Also write the summary to this file, as JSON for .json, CSV for .csv and text otherwise")
+	outputFile := fs.String("output-file", "", "Write the paths of --list-unused, --list-missing and --list-metadata-files (and the --list-missing-formatted commands) to this file instead of stdout")
+	outputSeparator := fs.String("output-separator", `\n`, "Separator written after each listed path, \\n, \\0 (NUL, for xargs -0) or any custom string")
+	maxUnusedRatio := fs.Int("max-unused-ratio", 100, "Refuse --remove-unused when more than this percentage of the files is unused (100 = no limit)")
+	maxRemoveBytes := fs.String("max-remove-bytes", "0", "Stop --remove-unused before freeing more than this size, smallest files first (e.g. 10GB, 0 = unlimited)")
+	uniqueBy := fs.String("compute-unique-by", "hash", "What makes files duplicates: hash (content), path (file name) or both")
+	watermarkPath := fs.String("watermark-path", "", "Skip the files below this directory or glob pattern, relative to the media path, e.g. watermark")
+	checkImageHeaders := fs.Bool("check-image-headers", false, "List JPEG, PNG, GIF, WebP and AVIF files whose magic bytes do not match their extension")
+	noHash := fs.Bool("no-hash", false, "Skip content hashing and treat files with the same name and size as duplicates (faster, may give false positives)")
+	sortByWaste := fs.Bool("sort-duplicates-by-waste", false, "Process the duplicate groups that waste the most space first with --remove-duplicates")
+	keepDuplicates := fs.Int("keep-N-duplicates", 1, "Number of copies of each duplicate group kept by --remove-duplicates")
+	excludeProducts := fs.String("exclude-products", "", "Comma separated SKUs whose images are never treated as unused or removed as duplicates")
+	excludeProductsFile := fs.String("exclude-products-file", "", "File with SKUs to exclude, one per line (blank lines and # comments are ignored)")
+	excludeAttributeSets := fs.String("exclude-attribute-set", "", "Comma separated attribute set IDs whose products' images are never treated as unused or removed as duplicates")
+	requireGalleryEntry := fs.Bool("require-gallery-entry", false, "Only count images referenced by both the media gallery and an image attribute as used")
+	includeOnlyProducts := fs.String("include-only-products", "", "Comma separated SKUs, only images referenced by these products are considered used")
+	galleryImageThreshold := fs.Int("gallery-image-threshold", 20, "Count products with more images than this in --report-gallery-stats")
+	verifyAfterRemove := fs.Bool("verify-after-remove", false, "Stat every file removed by --remove-unused and --remove-duplicates again and warn if it still exists")
+	checkWritable := fs.Bool("check-writable", false, "Test every directory with a file to remove for write access first and skip the files of directories that fail")
+	ignoreErrors := fs.Bool("ignore-errors", false, "Log failed file operations to stderr and continue instead of stopping at the first failure")
+	exitOnFirstError := fs.Bool("exit-on-first-error", false, "Also stop all cleanup at the first failed database query, batch update or directory scan and exit with code 1")
+
+	// Debug flags
+	mockDB := fs.String("mock-db", "", "Use an in-memory mock database seeded with gallery paths from this file (one per line)")
+	fakeFilesystem := fs.String("fake-filesystem", "", "Read the files from manifest.json in this directory instead of scanning the media path")
+	batchDelay := fs.Duration("remove-duplicates-batch-delay", 0, "Pause between the batches of --remove-duplicates, e.g. 500ms, to reduce lock contention")
+	importDuplicatesMap := fs.String("import-duplicates-map", "", "Read the duplicate groups from a --export-duplicates-map file instead of scanning, for --list-duplicates and --remove-duplicates")
+	exportDuplicatesMap := fs.String("export-duplicates-map", "", "Scan the media path, write the duplicate groups to this JSON file and exit without touching the database or files")
+	benchmark := fs.Bool("benchmark", false, "Only scan the filesystem (no database) and report throughput")
+	logFile := fs.String("log-file", "", "Append all output to this file, with a timestamp on each line")
+	logRotation := fs.String("log-rotation", "", "Rotate --log-file at a size and delete rotated files after an age, e.g. \"100MB 7d\"")
+	trackMemory := fs.Bool("track-memory", false, "Sample the heap in use every second during the scan and report the peak")
+	maxMemory := fs.String("max-memory", "0", "Warn if the peak heap in use exceeds this size, e.g. 2GB (implies --track-memory, 0 = no limit)")
+	fs.BoolVar(&printSQL, "print-sql", false, "Print every SQL statement and its arguments to stderr")
+	profileCPU := fs.String("profile-cpu", "", "Write a CPU profile of the scan to this file (needs a build with -tags profile)")
+	profileMem := fs.String("profile-mem", "", "Write a heap profile after the scan to this file (needs a build with -tags profile)")
+	verbose := fs.Bool("verbose", false, "Print the time spent on each step after the summary")
+	logLevel := fs.String("log-level", "info", "Log level: info or debug (debug implies --print-sql)")
+
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
 
-	flag.BoolVar(&listUnused, "list-unused", false, "List unused media files")
-	flag.BoolVar(&listUnused, "u", false, "List unused media files (shorthand)")
+	if *reportFormatVersion {
+		fmt.Fprintln(stdout, statsSchemaVersion)
+		return 0
+	}
 
-	flag.BoolVar(&listMissing, "list-missing", false, "List missing media files")
-	flag.BoolVar(&listMissing, "m", false, "List missing media files (shorthand)")
+	if listAll {
+		listUnused, listMissing, listDupes = true, true, true
+	}
 
-	flag.BoolVar(&listDupes, "list-duplicates", false, "List duplicated files")
-	flag.BoolVar(&listDupes, "d", false, "List duplicated files (shorthand)")
+	if *logRotation != "" && *logFile == "" {
+		fmt.Fprintln(stdout, "Error: --log-rotation requires --log-file")
+		return 1
+	}
 
-	flag.BoolVar(&removeUnused, "remove-unused", false, "Remove unused product images")
-	flag.BoolVar(&removeUnused, "r", false, "Remove unused product images (shorthand)")
+	if *logFile != "" {
+		var maxSize int64
+		var maxAge time.Duration
+		var err error
+		if *logRotation != "" {
+			parts := strings.Fields(*logRotation)
+			if len(parts) != 2 {
+				fmt.Fprintf(stdout, "Error: Invalid --log-rotation '%s' (expected \"<max-size> <max-age>\", e.g. \"100MB 7d\")\n", *logRotation)
+				return 1
+			}
+			if maxSize, err = parseBytes(parts[0]); err != nil {
+				fmt.Fprintf(stdout, "Error: Invalid --log-rotation size '%s': %v\n", parts[0], err)
+				return 1
+			}
+			if maxAge, err = parseAge(parts[1]); err != nil {
+				fmt.Fprintf(stdout, "Error: Invalid --log-rotation age '%s': %v\n", parts[1], err)
+				return 1
+			}
+		}
 
-	flag.BoolVar(&removeOrphans, "remove-orphans", false, "Remove orphaned media gallery rows")
-	flag.BoolVar(&removeOrphans, "o", false, "Remove orphaned media gallery rows (shorthand)")
+		f, err := openRotatingFile(*logFile, maxSize, maxAge)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error: Cannot open log file '%s': %v\n", *logFile, err)
+			return 1
+		}
+		defer f.Close()
 
-	flag.BoolVar(&removeDupes, "remove-duplicates", false, "Remove duplicated files and update database")
-	flag.BoolVar(&removeDupes, "x", false, "Remove duplicated files and update database (shorthand)")
+		log := &timestampWriter{w: f}
+		stdout = io.MultiWriter(out, log)
+		stderr = io.MultiWriter(errOut, log)
+	}
 
-	// Configuration flags
-	magentoRoot := flag.String("magento-root", "", "Path to Magento root directory (optional, auto-detects if not provided)")
-	dbHost := flag.String("db-host", "localhost", "Database host (optional, reads from app/etc/env.php if not provided)")
-	dbPort := flag.String("db-port", "3306", "Database port (optional, reads from app/etc/env.php if not provided)")
-	dbName := flag.String("db-name", "", "Database name (optional, reads from app/etc/env.php if not provided)")
-	dbUser := flag.String("db-user", "", "Database user (optional, reads from app/etc/env.php if not provided)")
-	dbPass := flag.String("db-pass", "", "Database password (optional, reads from app/etc/env.php if not provided)")
-	dbPrefix := flag.String("db-prefix", "", "Database table prefix (optional, reads from app/etc/env.php if not provided)")
-	mediaPath := flag.String("media-path", "", "Path to pub/media/catalog/product (optional, defaults to <magento_root>/pub/media/catalog/product)")
-	workers := flag.Int("workers", 10, "Number of parallel workers for file scanning")
-
-	flag.Parse()
+	switch *logLevel {
+	case "info":
+	case "debug":
+		printSQL = true
+	default:
+		fmt.Fprintf(stdout, "Error: Invalid --log-level '%s' (expected info or debug)\n", *logLevel)
+		return 1
+	}
 
 	var config Config
 	var resolvedMagentoRoot string
@@ -125,8 +652,8 @@ func main() {
 		// User provided explicit Magento root
 		envPath := filepath.Join(*magentoRoot, "app", "etc", "env.php")
 		if _, err := os.Stat(envPath); os.IsNotExist(err) {
-			fmt.Printf("Error: Invalid Magento root directory '%s' (app/etc/env.php not found)\n", *magentoRoot)
-			os.Exit(1)
+			fmt.Fprintf(stdout, "Error: Invalid Magento root directory '%s' (app/etc/env.php not found)\n", *magentoRoot)
+			return 1
 		}
 		resolvedMagentoRoot = *magentoRoot
 	} else {
@@ -139,15 +666,27 @@ func main() {
 		resolvedMagentoRoot, err = findMagentoRoot(startPath)
 	}
 
+	if !regexp.MustCompile(`^[A-Za-z0-9_]+$`).MatchString(*dbRole) {
+		fmt.Fprintf(stdout, "Error: Invalid --db-role '%s' (expected a connection name like default or indexer)\n", *dbRole)
+		return 1
+	}
+
 	// If we found a Magento root, try to load env.php
 	if resolvedMagentoRoot != "" {
-		fmt.Printf("Found Magento root: %s\n", resolvedMagentoRoot)
-
-		envConfig, err = loadConfigFromEnvPHP(resolvedMagentoRoot)
-		if err != nil {
-			fmt.Printf("Warning: Could not read env.php: %v\n", err)
+		fmt.Fprintf(stdout, "Found Magento root: %s\n", resolvedMagentoRoot)
+
+		envConfig, err = loadConfigFromEnvPHP(resolvedMagentoRoot, *dbRole)
+		if err != nil && *dbRole != "default" {
+			// Falling back to localhost would silently use another database
+			fmt.Fprintf(stdout, "Error: Could not read the '%s' connection from env.php: %v\n", *dbRole, err)
+			return 1
+		} else if err != nil {
+			fmt.Fprintf(stdout, "Warning: Could not read env.php: %v\n", err)
 		} else {
 			loadedFromEnv = true
+			if *dbRole != "default" {
+				fmt.Fprintf(stdout, "Using the '%s' connection from env.php\n", *dbRole)
+			}
 		}
 
 		// Set media path default if not provided
@@ -176,7 +715,7 @@ func main() {
 	passSet := false
 	prefixSet := false
 
-	flag.Visit(func(f *flag.Flag) {
+	fs.Visit(func(f *flag.Flag) {
 		switch f.Name {
 		case "db-host":
 			hostSet = true
@@ -200,6 +739,10 @@ func main() {
 	if portSet {
 		config.DBPort = *dbPort
 	}
+	if hostSet || portSet {
+		// An explicit host or port means TCP, not the socket from env.php
+		config.DBSocket = ""
+	}
 	if nameSet {
 		config.DBName = *dbName
 	}
@@ -212,37 +755,314 @@ func main() {
 	if prefixSet {
 		sanitized := sanitizeTablePrefix(*dbPrefix)
 		if sanitized != *dbPrefix {
-			fmt.Printf("Warning: db-prefix sanitized from '%s' to '%s'\n", *dbPrefix, sanitized)
+			fmt.Fprintf(stdout, "Warning: db-prefix sanitized from '%s' to '%s'\n", *dbPrefix, sanitized)
 		}
 		config.DBTablePrefix = sanitized
 	}
 
+	if *dbDSN != "" {
+		if *connectionStringFile != "" {
+			fmt.Fprintln(stdout, "Warning: --db-dsn takes precedence over --connection-string-file")
+		}
+		config.DBDSN = *dbDSN
+	} else if *connectionStringFile != "" {
+		content, err := os.ReadFile(*connectionStringFile)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error: Cannot read --connection-string-file '%s': %v\n", *connectionStringFile, err)
+			return 1
+		}
+		config.DBDSN = strings.TrimSpace(string(content))
+		if config.DBDSN == "" {
+			fmt.Fprintf(stdout, "Error: --connection-string-file '%s' is empty\n", *connectionStringFile)
+			return 1
+		}
+	}
+	if config.DBDSN != "" {
+		// The database name is still needed for --db-prefix-detection
+		config.DBUser, _, config.DBName = splitDSN(config.DBDSN)
+	}
+
+	config.DBInitStmts = dbInitStmts
+	config.DBInitMagento = *dbInitOnConnect
+	if config.DBMaxPacket, err = parseBytes(*dbMaxPacket); err != nil {
+		fmt.Fprintf(stdout, "Error: Invalid --db-max-packet '%s': %v\n", *dbMaxPacket, err)
+		return 1
+	}
+	config.DBReadTimeout = *dbReadTimeout
+	config.DBWriteTimeout = *dbWriteTimeout
+
+	if _, err := time.LoadLocation(*dbTimezone); err != nil {
+		fmt.Fprintf(stdout, "Error: Invalid --db-timezone '%s': %v\n", *dbTimezone, err)
+		return 1
+	}
+	config.DBTimezone = *dbTimezone
+
+	// Written into the queries, so it has to be a plain name
+	if *dbCollation != "" && !regexp.MustCompile(`^[A-Za-z0-9_]+$`).MatchString(*dbCollation) {
+		fmt.Fprintf(stdout, "Error: Invalid --db-collation '%s'\n", *dbCollation)
+		return 1
+	}
+	config.DBCollation = *dbCollation
+
 	// Set media path and workers
 	if *mediaPath != "" {
 		config.MediaPath = *mediaPath
 	}
+	if *fakeFilesystem != "" {
+		config.MediaPath = *fakeFilesystem
+	}
 	config.WorkerCount = *workers
+	config.WalkerCount = *walkerWorkers
+	config.HashWorkers = *hashWorkers
+	if config.HashWorkers == 0 {
+		config.HashWorkers = config.WorkerCount
+	}
+	if config.WorkerCount < 1 || config.WalkerCount < 1 || config.HashWorkers < 1 {
+		fmt.Fprintln(stdout, "Error: --workers, --walker-workers and --hash-workers must be at least 1")
+		return 1
+	}
+	switch *hashStrategy {
+	case "concurrent":
+	case "sequential-dir":
+		// A single walker reads the directories one after another
+		config.WalkerCount = 1
+	default:
+		fmt.Fprintf(stdout, "Error: Invalid --parallel-hash-strategy '%s' (expected concurrent or sequential-dir)\n", *hashStrategy)
+		return 1
+	}
+	config.HashStrategy = *hashStrategy
+	if *maxDepth < 0 {
+		fmt.Fprintln(stdout, "Error: --max-depth cannot be negative")
+		return 1
+	}
+	config.MaxDepth = *maxDepth
+	if *maxFilesPerDir < 0 {
+		fmt.Fprintln(stdout, "Error: --max-files-per-dir cannot be negative")
+		return 1
+	}
+	config.MaxFilesPerDir = *maxFilesPerDir
+
+	config.OnlyPathPrefix = *onlyPathPrefix
+	if config.OnlyPathPrefix != "" && !strings.HasPrefix(config.OnlyPathPrefix, "/") {
+		// Gallery values always start with a slash
+		config.OnlyPathPrefix = "/" + config.OnlyPathPrefix
+	}
+
+	config.MmapThreshold, err = parseBytes(*mmapThreshold)
+	if err != nil {
+		fmt.Fprintf(stdout, "Error: Invalid --mmap-threshold '%s': %v\n", *mmapThreshold, err)
+		return 1
+	}
+
+	switch *dedupStrategy {
+	case "", "keep-largest", "keep-smallest", "keep-oldest", "keep-newest":
+		config.DedupStrategy = *dedupStrategy
+	default:
+		fmt.Fprintf(stdout, "Error: Invalid --dedup-strategy '%s' (expected keep-largest, keep-smallest, keep-oldest or keep-newest)\n", *dedupStrategy)
+		return 1
+	}
+
+	switch *uniqueBy {
+	case "hash", "path", "both":
+		config.UniqueBy = *uniqueBy
+	default:
+		fmt.Fprintf(stdout, "Error: Invalid --compute-unique-by '%s' (expected hash, path or both)\n", *uniqueBy)
+		return 1
+	}
+	if *noHash {
+		if config.UniqueBy != "hash" {
+			fmt.Fprintln(stdout, "Error: --no-hash cannot be combined with --compute-unique-by")
+			return 1
+		}
+		config.NoHash = true
+		config.UniqueBy = "name-size"
+	}
+
+	if listAll && (removeUnused || removeOrphans || removeDupes || removeMetadata || removeCachedOnly || removeDanglingLinks) {
+		fmt.Fprintln(stdout, "Warning: --all is for listing only, the remove operations given separately still run")
+	}
+
+	if (*profileCPU != "" || *profileMem != "") && !profilingSupported {
+		fmt.Fprintln(stdout, "Error: --profile-cpu and --profile-mem need a build with -tags profile")
+		return 1
+	}
+
+	if *exitOnFirstError && *ignoreErrors {
+		fmt.Fprintln(stdout, "Error: --exit-on-first-error cannot be combined with --ignore-errors")
+		return 1
+	}
+	config.IgnoreErrors = *ignoreErrors
+	config.ExitOnFirstError = *exitOnFirstError
+	config.CheckImageHeaders = *checkImageHeaders
+	config.WatermarkPath = strings.Trim(*watermarkPath, "/")
+
+	maxMemoryBytes, err := parseBytes(*maxMemory)
+	if err != nil {
+		fmt.Fprintf(stdout, "Error: Invalid --max-memory '%s': %v\n", *maxMemory, err)
+		return 1
+	}
+	if maxMemoryBytes > 0 {
+		*trackMemory = true
+	}
+
+	switch *format {
+	case "text", "table", "ndjson":
+	case "json":
+		if !*countOnly {
+			fmt.Fprintln(stdout, "Error: --format json requires --count-only")
+			return 1
+		}
+	default:
+		fmt.Fprintf(stdout, "Error: Invalid --format '%s' (expected text, table, ndjson or json)\n", *format)
+		return 1
+	}
+	if *countOnly {
+		listUnused, listMissing, listDupes, listMetadata = false, false, false, false
+	}
+
+	includedSKUs, _ := readSKUList(*includeOnlyProducts, "")
+
+	excludedSKUs, err := readSKUList(*excludeProducts, *excludeProductsFile)
+	if err != nil {
+		fmt.Fprintf(stdout, "Error: Cannot read --exclude-products-file '%s': %v\n", *excludeProductsFile, err)
+		return 1
+	}
+
+	var excludedSets []int64
+	for _, field := range strings.Split(*excludeAttributeSets, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil || id < 1 {
+			fmt.Fprintf(stdout, "Error: Invalid attribute set ID '%s' in --exclude-attribute-set\n", field)
+			return 1
+		}
+		excludedSets = append(excludedSets, id)
+	}
+
+	if *maxUnusedRatio < 0 || *maxUnusedRatio > 100 {
+		fmt.Fprintln(stdout, "Error: --max-unused-ratio must be between 0 and 100")
+		return 1
+	}
+	config.MaxUnusedRatio = *maxUnusedRatio
+
+	importNameRegexp, err := regexp.Compile(*importNamePattern)
+	if err != nil {
+		fmt.Fprintf(stdout, "Error: Invalid --import-name-pattern '%s': %v\n", *importNamePattern, err)
+		return 1
+	}
+
+	if *keepDuplicates < 1 {
+		fmt.Fprintln(stdout, "Error: --keep-N-duplicates must be at least 1")
+		return 1
+	}
+
+	if *batchDelay < 0 {
+		fmt.Fprintln(stdout, "Error: --remove-duplicates-batch-delay cannot be negative")
+		return 1
+	}
+
+	config.MinAge = *minAge
+	if *excludeRecentlyModified != "" {
+		if *minAge != 0 {
+			fmt.Fprintln(stdout, "Error: --exclude-recently-modified cannot be combined with --min-age")
+			return 1
+		}
+		config.MinAge, err = parseCalendarAge(*excludeRecentlyModified)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error: Invalid --exclude-recently-modified '%s': %v\n", *excludeRecentlyModified, err)
+			return 1
+		}
+	}
+	if config.MinAge < 0 {
+		fmt.Fprintln(stdout, "Error: --min-age cannot be negative")
+		return 1
+	}
+
+	config.MaxRemoveBytes, err = parseBytes(*maxRemoveBytes)
+	if err != nil {
+		fmt.Fprintf(stdout, "Error: Invalid --max-remove-bytes '%s': %v\n", *maxRemoveBytes, err)
+		return 1
+	}
 
 	// Validate required fields
-	if config.DBName == "" || config.DBUser == "" {
-		fmt.Println("Error: Database name and user are required.")
-		fmt.Println("Please either:")
-		fmt.Println("  1. Run this command from within a Magento installation,")
-		fmt.Println("  2. Provide -magento-root flag, or")
-		fmt.Println("  3. Provide -db-name and -db-user flags")
-		flag.Usage()
-		os.Exit(1)
+	if !*benchmark && *mockDB == "" && *exportDuplicatesMap == "" && (config.DBName == "" || config.DBUser == "") {
+		fmt.Fprintln(stdout, "Error: Database name and user are required.")
+		fmt.Fprintln(stdout, "Please either:")
+		fmt.Fprintln(stdout, "  1. Run this command from within a Magento installation,")
+		fmt.Fprintln(stdout, "  2. Provide -magento-root flag, or")
+		fmt.Fprintln(stdout, "  3. Provide -db-name and -db-user flags")
+		fs.Usage()
+		return 1
 	}
 
 	if config.MediaPath == "" {
-		fmt.Println("Error: -media-path is required when not using -magento-root")
-		flag.Usage()
-		os.Exit(1)
+		fmt.Fprintln(stdout, "Error: -media-path is required when not using -magento-root")
+		fs.Usage()
+		return 1
+	}
+
+	if *fakeFilesystem != "" {
+		if *benchmark || *importDuplicatesMap != "" || *exportDuplicatesMap != "" {
+			fmt.Fprintln(stdout, "Error: --fake-filesystem cannot be combined with --benchmark, --import-duplicates-map or --export-duplicates-map")
+			return 1
+		}
+		if removeUnused || removeDupes || removeMetadata || removeCachedOnly || fixPathEncoding {
+			fmt.Fprintln(stdout, "Error: --fake-filesystem has no files to remove or rename, use it with the list and report operations")
+			return 1
+		}
+	}
+
+	if *benchmark {
+		if _, err := os.Stat(config.MediaPath); os.IsNotExist(err) {
+			fmt.Fprintf(stdout, "Cannot find \"%s\" folder.\n", config.MediaPath)
+			return 1
+		}
+
+		fmt.Fprintf(stdout, "Benchmarking filesystem scan of %s\n", config.MediaPath)
+		fmt.Fprintf(stdout, "  Workers: %d stat, %d hash, %d walker\n", config.WorkerCount, config.HashWorkers, config.WalkerCount)
+
+		stats := &Stats{}
+		scanStart := time.Now()
+		scanFilesystem(config, stats)
+		printBenchmark(stats, config, time.Since(scanStart))
+		return 0
+	}
+
+	if *importDuplicatesMap != "" {
+		if *exportDuplicatesMap != "" {
+			fmt.Fprintln(stdout, "Error: --import-duplicates-map cannot be combined with --export-duplicates-map")
+			return 1
+		}
+		if listUnused || listMissing || listMissingFormatted || removeUnused || removeOrphans || listMetadata || removeMetadata || listCachedOnly || removeCachedOnly || reportPathEncoding || fixPathEncoding || reportMimeDistribution ||
+			fixVarcharOnly || fixVarcharWithoutGallery || includeSwatches || includeCustomerUpload || reportImportCandidates {
+			fmt.Fprintln(stdout, "Error: --import-duplicates-map only holds the duplicate files, use it with --list-duplicates or --remove-duplicates")
+			return 1
+		}
+	}
+
+	if *exportDuplicatesMap != "" {
+		if _, err := os.Stat(config.MediaPath); os.IsNotExist(err) {
+			fmt.Fprintf(stdout, "Cannot find \"%s\" folder.\n", config.MediaPath)
+			return 1
+		}
+
+		fmt.Fprintf(stdout, "Scanning %s for duplicates...\n", config.MediaPath)
+		stats := &Stats{}
+		scanResult := scanFilesystem(config, stats)
+		groups, err := writeDuplicatesMap(*exportDuplicatesMap, config, scanResult.HashMap)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error: Cannot write --export-duplicates-map '%s': %v\n", *exportDuplicatesMap, err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "Exported %d duplicate groups (%d duplicates) to %s\n", groups, stats.DuplicateFiles, *exportDuplicatesMap)
+		return 0
 	}
 
 	// Print configuration summary
 	if loadedFromEnv {
-		fmt.Printf("Loaded database configuration from env.php")
+		fmt.Fprintf(stdout, "Loaded database configuration from env.php")
 		// Check if any CLI flags override env.php
 		overrides := []string{}
 		if hostSet {
@@ -264,154 +1084,1047 @@ func main() {
 			overrides = append(overrides, "prefix")
 		}
 		if len(overrides) > 0 {
-			fmt.Printf(" (overridden: %s)", strings.Join(overrides, ", "))
+			fmt.Fprintf(stdout, " (overridden: %s)", strings.Join(overrides, ", "))
 		}
-		fmt.Println()
+		fmt.Fprintln(stdout)
 	}
 
-	fmt.Printf("  Database: %s@%s:%s/%s\n", config.DBUser, config.DBHost, config.DBPort, config.DBName)
+	if *mockDB != "" {
+		fmt.Fprintf(stdout, "  Database: mock, seeded from %s\n", *mockDB)
+	} else {
+		fmt.Fprintf(stdout, "  Database: %s\n", describeDB(config))
+	}
 	if config.DBTablePrefix != "" {
-		fmt.Printf("  Table prefix: %s\n", config.DBTablePrefix)
+		fmt.Fprintf(stdout, "  Table prefix: %s\n", config.DBTablePrefix)
+	}
+	fmt.Fprintf(stdout, "  Media path: %s\n", config.MediaPath)
+	if config.OnlyPathPrefix != "" {
+		fmt.Fprintf(stdout, "  Path prefix: %s\n", config.OnlyPathPrefix)
 	}
-	fmt.Printf("  Media path: %s\n", config.MediaPath)
 
 	// Connect to database
-	db, err := connectDB(config)
+	var db *sql.DB
+	if *mockDB != "" {
+		if *splitDB {
+			fmt.Fprintln(stdout, "Error: --split-db cannot be combined with --mock-db")
+			return 1
+		}
+		db, err = openMockDB(*mockDB)
+	} else {
+		db, err = connectDB(config)
+	}
 	if err != nil {
-		fmt.Printf("Database connection error: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintf(stdout, "Database connection error: %v\n", err)
+		return 1
 	}
 	defer db.Close()
 
+	// The session value of max_allowed_packet is read-only, a larger client
+	// limit only helps if the server accepts packets of that size as well
+	if config.DBMaxPacket > 0 {
+		var serverMaxPacket int64
+		if err := dbQueryRow(db, "SELECT @@global.max_allowed_packet").Scan(&serverMaxPacket); err == nil && serverMaxPacket < config.DBMaxPacket {
+			fmt.Fprintf(stdout, "Warning: The server's max_allowed_packet is %d bytes, lower than --db-max-packet %d\n", serverMaxPacket, config.DBMaxPacket)
+		}
+	}
+
+	if *prefixDetection && !prefixSet && !loadedFromEnv && *mockDB == "" {
+		prefix, err := detectTablePrefix(db, config.DBName)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error detecting table prefix: %v\n", err)
+			return 1
+		}
+		config.DBTablePrefix = prefix
+		fmt.Fprintf(stdout, "  Detected table prefix: '%s'\n", prefix)
+	}
+
+	// All catalog_product_* tables live in the catalog database on split
+	// database installations, every other table in the default one
+	catalogDB := db
+	if *splitDB {
+		if resolvedMagentoRoot == "" {
+			fmt.Fprintln(stdout, "Error: --split-db requires env.php (run from a Magento installation or use --magento-root)")
+			return 1
+		}
+
+		catalogEnv, err := loadConfigFromEnvPHP(resolvedMagentoRoot, "catalog")
+		if err != nil {
+			fmt.Fprintf(stdout, "Error reading catalog connection: %v\n", err)
+			return 1
+		}
+		catalogConfig := config
+		catalogConfig.DBDSN = ""
+		catalogConfig.DBHost = catalogEnv.DBHost
+		catalogConfig.DBPort = catalogEnv.DBPort
+		catalogConfig.DBSocket = catalogEnv.DBSocket
+		catalogConfig.DBName = catalogEnv.DBName
+		catalogConfig.DBUser = catalogEnv.DBUser
+		catalogConfig.DBPass = catalogEnv.DBPass
+
+		catalogDB, err = connectDB(catalogConfig)
+		if err != nil {
+			fmt.Fprintf(stdout, "Catalog database connection error: %v\n", err)
+			return 1
+		}
+		defer catalogDB.Close()
+		fmt.Fprintf(stdout, "  Catalog database: %s\n", describeDB(catalogConfig))
+	}
+
+	catalog := DBConn{DB: catalogDB, ReadDB: catalogDB}
+	if *dbReadHost != "" {
+		if *mockDB != "" || *splitDB {
+			fmt.Fprintln(stdout, "Error: --db-read-host cannot be combined with --mock-db or --split-db")
+			return 1
+		}
+
+		if config.DBDSN != "" {
+			fmt.Fprintln(stdout, "Error: --db-read-host cannot be combined with --db-dsn or --connection-string-file")
+			return 1
+		}
+
+		readConfig := config
+		readConfig.DBHost = *dbReadHost
+		readConfig.DBSocket = ""
+		if *dbReadPort != "" {
+			readConfig.DBPort = *dbReadPort
+		}
+
+		catalog.ReadDB, err = connectDB(readConfig)
+		if err != nil {
+			fmt.Fprintf(stdout, "Read replica connection error: %v\n", err)
+			return 1
+		}
+		defer catalog.ReadDB.Close()
+		fmt.Fprintf(stdout, "  Read replica: %s\n", describeDB(readConfig))
+	}
+
+	// Only needs the database, a few files are sampled for the sizes
+	if computeDedupSavings {
+		if err := printDedupSavings(catalog.ReadDB, config); err != nil {
+			fmt.Fprintf(stdout, "Error querying gallery values: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
 	// Verify media path exists
 	if _, err := os.Stat(config.MediaPath); os.IsNotExist(err) {
-		fmt.Printf("Cannot find \"%s\" folder.\n", config.MediaPath)
-		fmt.Println("It appears there are no product images to analyze.")
-		os.Exit(1)
+		fmt.Fprintf(stdout, "Cannot find \"%s\" folder.\n", config.MediaPath)
+		fmt.Fprintln(stdout, "It appears there are no product images to analyze.")
+		return 1
 	}
 
 	stats := &Stats{}
 	startTime := time.Now()
 
 	// Scan filesystem with parallel workers
-	fmt.Println("\nScanning filesystem...")
+	if *importDuplicatesMap != "" {
+		fmt.Fprintf(stdout, "\nReading duplicates from %s...\n", *importDuplicatesMap)
+	} else {
+		fmt.Fprintln(stdout, "\nScanning filesystem...")
+	}
 	scanStart := time.Now()
-	filesMap, hashMap := scanFilesystem(config, stats)
+	var stopMemorySampler func() int64
+	if *trackMemory {
+		stopMemorySampler = startMemorySampler(time.Second)
+	}
+	var stopCPUProfile func()
+	if *profileCPU != "" {
+		stopCPUProfile, err = startCPUProfile(*profileCPU)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error: Cannot start CPU profile '%s': %v\n", *profileCPU, err)
+			return 1
+		}
+	}
+	var scanResult ScanResult
+	if *importDuplicatesMap != "" {
+		scanResult, err = readDuplicatesMap(*importDuplicatesMap, config, stats)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error: Cannot read --import-duplicates-map '%s': %v\n", *importDuplicatesMap, err)
+			return 1
+		}
+	} else if *fakeFilesystem != "" {
+		scanResult, err = readFakeFilesystem(filepath.Join(*fakeFilesystem, "manifest.json"), config, stats)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error: Cannot read --fake-filesystem manifest: %v\n", err)
+			return 1
+		}
+	} else {
+		scanResult = scanFilesystem(config, stats)
+	}
+	filesMap, hashMap := scanResult.FilesMap, scanResult.HashMap
 	scanDuration := time.Since(scanStart)
 
+	// Set when a file operation or directory read failed without
+	// --ignore-errors, all further cleanup operations are skipped. With
+	// --exit-on-first-error the run ends right away instead.
+	stopped := scanResult.Stopped
+	if stopped && config.ExitOnFirstError {
+		return 1
+	}
+	printOvercrowdedDirs(scanResult.OvercrowdedDirs, config.MaxFilesPerDir)
+	if countDistinctHashes && *importDuplicatesMap == "" {
+		// Files with a unique size are never hashed but have unique
+		// content, every group adds one distinct content
+		stats.DistinctHashes = stats.TotalFiles - stats.DuplicateFiles
+	}
+	if stopCPUProfile != nil {
+		stopCPUProfile()
+	}
+	if *profileMem != "" {
+		if err := writeHeapProfile(*profileMem); err != nil {
+			fmt.Fprintf(stdout, "Warning: Cannot write heap profile '%s': %v\n", *profileMem, err)
+		}
+	}
+	if stopMemorySampler != nil {
+		stats.PeakMemory = stopMemorySampler()
+		if maxMemoryBytes > 0 && stats.PeakMemory > maxMemoryBytes {
+			fmt.Fprintf(stdout, "Warning: Peak memory used during the scan (%.2f GB) exceeds --max-memory (%.2f GB)\n",
+				float64(stats.PeakMemory)/(1<<30), float64(maxMemoryBytes)/(1<<30))
+		}
+	}
+
+	// Renamed before the gallery is read, so the fixed paths are neither
+	// unused nor missing below
+	if fixPathEncoding && !stopped {
+		renamed, failed := fixPathEncodings(catalog.DB, config, stats, findPathEncodingIssues(filesMap))
+		renameScannedFiles(filesMap, hashMap, renamed)
+		if failed && config.ExitOnFirstError {
+			return 1
+		}
+		stopped = failed
+	}
+
 	// Fetch media gallery entries from database
-	fmt.Println("Querying database...")
+	fmt.Fprintln(stdout, "Querying database...")
 	dbStart := time.Now()
-	dbPaths, err := getMediaGalleryPaths(db, config)
+	dbPaths, varcharPaths, err := getMediaGalleryPaths(catalog.ReadDB, config, stats)
 	if err != nil {
-		fmt.Printf("Error querying database: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintf(stdout, "Error querying database: %v\n", err)
+		return 1
+	}
+	if stats.NullGalleryValues > 0 && !fixNullGalleryValues {
+		fmt.Fprintf(stdout, "Warning: %d media gallery rows have a NULL value, delete them with --fix-null-gallery-values\n", stats.NullGalleryValues)
+	}
+	if stats.EmptyGalleryValues > 0 && !removeEmptyGalleryValues {
+		fmt.Fprintf(stdout, "Warning: %d media gallery rows have an empty value, delete them with --remove-empty-gallery-values\n", stats.EmptyGalleryValues)
 	}
-	dbDuration := time.Since(dbStart)
 
-	// Convert to map for faster lookups
-	dbPathsMap := make(map[string]bool, len(dbPaths))
+	// Compare the gallery with the image attributes, older imports often
+	// only filled the attributes
+	galleryPathsMap := make(map[string]bool, len(dbPaths))
 	for _, path := range dbPaths {
-		dbPathsMap[path] = true
+		galleryPathsMap[path] = true
+	}
+	var varcharOnly []string
+	for _, path := range varcharPaths {
+		if galleryPathsMap[path] {
+			stats.InBothTables++
+		} else {
+			stats.VarcharOnly++
+			varcharOnly = append(varcharOnly, path)
+		}
 	}
+	stats.GalleryOnly = int64(len(galleryPathsMap)) - stats.InBothTables
+
+	// Runs before unused detection, so the images it adds to the gallery
+	// are not removed by --remove-unused in the same run
+	if fixVarcharOnly {
+		var existing []string
+		for _, path := range varcharOnly {
+			if _, exists := filesMap[path]; exists {
+				existing = append(existing, path)
+			}
+		}
 
-	// Find unused files (in filesystem but not in DB)
-	unusedFiles := []string{}
-	for path := range filesMap {
-		if !dbPathsMap[path] {
-			atomic.AddInt64(&stats.UnusedFiles, 1)
-			unusedFiles = append(unusedFiles, path)
+		fmt.Fprintf(stdout, "Adding gallery rows for %d images only referenced by image attributes...\n", len(existing))
+		inserted, err := insertGalleryRowsForVarchar(catalog, config, existing)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error adding gallery rows: %v\n", err)
+		} else {
+			stats.InsertedGallery = inserted
+			dbPaths = append(dbPaths, existing...)
 		}
 	}
 
-	// Find missing files (in DB but not in filesystem)
-	missingFiles := []string{}
-	for path := range dbPathsMap {
-		if _, exists := filesMap[path]; !exists {
-			atomic.AddInt64(&stats.MissingFiles, 1)
-			missingFiles = append(missingFiles, path)
+	if findVarcharWithoutGallery || fixVarcharWithoutGallery {
+		images, err := getVarcharWithoutGallery(catalog.ReadDB, config)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error finding image roles without gallery rows: %v\n", err)
+		} else {
+			stats.MissingGalleryRows = int64(len(images))
+			if findVarcharWithoutGallery {
+				fmt.Fprintln(stdout, "\nImage roles without gallery row:")
+				tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(tw, "SKU\tATTRIBUTE\tPATH")
+				for _, image := range images {
+					fmt.Fprintf(tw, "%s\t%s\t%s\n", image.SKU, image.AttributeCode, image.Path)
+				}
+				tw.Flush()
+				fmt.Fprintf(stdout, "Found %d image roles without gallery row\n", len(images))
+			}
+
+			if fixVarcharWithoutGallery {
+				// Gallery rows for missing files would only be removed
+				// again by --remove-orphans
+				var existing []VarcharRoleImage
+				for _, image := range images {
+					if _, exists := filesMap[image.Path]; exists {
+						existing = append(existing, image)
+					}
+				}
+
+				fmt.Fprintf(stdout, "Adding gallery rows for %d image roles without gallery row...\n", len(existing))
+				inserted, err := insertGalleryRowsForProducts(catalog, config, existing)
+				if err != nil {
+					fmt.Fprintf(stdout, "Error adding gallery rows: %v\n", err)
+				} else {
+					stats.InsertedGallery += inserted
+					for _, image := range existing {
+						dbPaths = append(dbPaths, image.Path)
+					}
+				}
+			}
 		}
 	}
 
-	// Process actions based on flags
-	if listUnused {
-		fmt.Println("\nUnused files:")
-		for _, path := range unusedFiles {
-			fmt.Println(path)
+	// Gallery images without an image role are not shown by Magento
+	if *requireGalleryEntry {
+		varcharPathsMap := make(map[string]bool, len(varcharPaths))
+		for _, path := range varcharPaths {
+			varcharPathsMap[path] = true
+		}
+		used := dbPaths[:0]
+		for _, path := range dbPaths {
+			if varcharPathsMap[path] {
+				used = append(used, path)
+			}
 		}
+		dbPaths = used
 	}
 
-	if removeUnused {
-		fmt.Println("\nRemoving unused files...")
-		for _, path := range unusedFiles {
-			fullPath := filepath.Join(config.MediaPath, path)
-			if info, err := os.Stat(fullPath); err == nil {
-				if err := os.Remove(fullPath); err == nil {
-					atomic.AddInt64(&stats.RemovedUnused, 1)
-					atomic.AddInt64(&stats.BytesFreed, info.Size())
-					fmt.Printf("Removed: %s\n", path)
-				}
+	// Only the images of the included products count as used, every other
+	// file is unused even if it is in the gallery
+	if len(includedSKUs) > 0 {
+		included, err := getProductImagePaths(catalog.ReadDB, config, includedSKUs)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error querying images of included products: %v\n", err)
+			return 1
+		}
+		dbPaths = dbPaths[:0]
+		for path := range included {
+			if matchesPathPrefix(config.OnlyPathPrefix, path, false) {
+				dbPaths = append(dbPaths, path)
 			}
 		}
+		fmt.Fprintf(stdout, "Restricted to %d images of %d included products\n", len(dbPaths), len(includedSKUs))
 	}
 
-	if listMissing {
-		fmt.Println("\nMissing files:")
-		for _, path := range missingFiles {
-			fmt.Println(path)
+	// Images of excluded products are never unused and never removed as a
+	// duplicate
+	var protected map[string]bool
+	if len(excludedSKUs) > 0 {
+		protected, err = getProductImagePaths(catalog.ReadDB, config, excludedSKUs)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error querying images of excluded products: %v\n", err)
+			return 1
 		}
+		fmt.Fprintf(stdout, "Protecting %d images of %d excluded products\n", len(protected), len(excludedSKUs))
 	}
 
-	if removeOrphans {
-		fmt.Println("\nRemoving orphaned database rows...")
-		removed, err := removeOrphanedRows(db, config, missingFiles)
+	if len(excludedSets) > 0 {
+		setPaths, err := getAttributeSetImagePaths(catalog.ReadDB, config, excludedSets)
 		if err != nil {
-			fmt.Printf("Error removing orphaned rows: %v\n", err)
-		} else {
-			atomic.AddInt64(&stats.RemovedOrphans, removed)
+			fmt.Fprintf(stdout, "Error querying images of excluded attribute sets: %v\n", err)
+			return 1
+		}
+		if protected == nil {
+			protected = make(map[string]bool, len(setPaths))
 		}
+		for path := range setPaths {
+			protected[path] = true
+		}
+		fmt.Fprintf(stdout, "Protecting %d images of products in %d excluded attribute sets\n", len(setPaths), len(excludedSets))
 	}
 
-	if listDupes {
-		fmt.Println("\nDuplicate files:")
-		for hash, files := range hashMap {
-			if len(files) > 1 {
-				fmt.Printf("Hash %016x:\n", hash)
-				for _, file := range files {
-					fmt.Printf("  - %s\n", file.RelativePath)
-				}
-			}
+	// Watermark images are referenced by the design configuration only
+	watermarks, err := getWatermarkPaths(db, config)
+	if err != nil {
+		fmt.Fprintf(stdout, "Warning: Cannot read the watermark configuration: %v\n", err)
+	} else if len(watermarks) > 0 {
+		if protected == nil {
+			protected = make(map[string]bool, len(watermarks))
 		}
+		for _, path := range watermarks {
+			protected[path] = true
+		}
+		fmt.Fprintf(stdout, "Protecting %d configured watermark images\n", len(watermarks))
 	}
 
-	if removeDupes {
-		fmt.Println("\nRemoving duplicate files...")
-		duplicateStart := time.Now()
+	// Size variants of one image are kept even if a variant has the same
+	// content, the gallery references each of them on purpose
+	var splitImages [][]FileInfo
+	if detectSplitImages {
+		splitImages = findSplitImages(filesMap, dbPaths)
+		if protected == nil {
+			protected = make(map[string]bool)
+		}
+		var variants int
+		for _, files := range splitImages {
+			for _, file := range files {
+				protected[file.RelativePath] = true
+			}
+			variants += len(files)
+		}
+		stats.SplitImageGroups = int64(len(splitImages))
+		fmt.Fprintf(stdout, "Protecting %d size variants of %d split images\n", variants, len(splitImages))
+	}
+	dbDuration := time.Since(dbStart)
 
-		// Collect all duplicate mappings
-		var allMappings []DuplicateMapping
-		for _, files := range hashMap {
-			if len(files) > 1 {
-				original := files[0].RelativePath
-				for i := 1; i < len(files); i++ {
-					duplicate := files[i]
-					allMappings = append(allMappings, DuplicateMapping{
-						Original:  original,
-						Duplicate: duplicate.RelativePath,
-						FullPath:  filepath.Join(config.MediaPath, duplicate.RelativePath),
-						Size:      duplicate.Size,
-					})
+	// Order duplicate groups so the copy to keep comes first
+	for _, files := range hashMap {
+		if len(files) < 2 {
+			continue
+		}
+		if config.DedupStrategy != "" {
+			sortDuplicateGroup(files, config.DedupStrategy)
+		}
+		if len(protected) > 0 && !protected[files[0].RelativePath] {
+			for i := 1; i < len(files); i++ {
+				if protected[files[i].RelativePath] {
+					files[0], files[i] = files[i], files[0]
+					break
 				}
 			}
 		}
+	}
 
-		fmt.Printf("Found %d duplicates to process\n", len(allMappings))
-
-		// Process in batches of 5000
-		const batchSize = 5000
-		totalBatches := (len(allMappings) + batchSize - 1) / batchSize
+	// Convert to map for faster lookups
+	dbPathsMap := make(map[string]bool, len(dbPaths))
+	for _, path := range dbPaths {
+		dbPathsMap[path] = true
+	}
+
+	// Find unused files (in filesystem but not in DB) and missing files (in
+	// DB but not in filesystem). An imported duplicates map only holds the
+	// duplicate files, every other file would look unused or missing.
+	buildStart := time.Now()
+	unusedFiles := []string{}
+	missingFiles := []string{}
+	if *importDuplicatesMap == "" {
+		var recentFiles int
+		minAgeCutoff := time.Now().Add(-config.MinAge)
+		for path, fileInfo := range filesMap {
+			if !dbPathsMap[path] && !protected[path] {
+				if config.MinAge > 0 && fileInfo.ModTime.After(minAgeCutoff) {
+					recentFiles++
+					continue
+				}
+				atomic.AddInt64(&stats.UnusedFiles, 1)
+				unusedFiles = append(unusedFiles, path)
+			}
+		}
+		if recentFiles > 0 {
+			fmt.Fprintf(stdout, "Skipped %d unreferenced files modified in the last %v\n", recentFiles, config.MinAge)
+		}
+
+		// Directories below --max-depth are not scanned, their files are not
+		// missing and must not be removed by --remove-orphans
+		var deepPaths int
+		for path := range dbPathsMap {
+			if _, exists := filesMap[path]; !exists {
+				if exceedsMaxDepth(config.MaxDepth, path) {
+					deepPaths++
+					continue
+				}
+				atomic.AddInt64(&stats.MissingFiles, 1)
+				missingFiles = append(missingFiles, path)
+			}
+		}
+		if deepPaths > 0 {
+			fmt.Fprintf(stdout, "Skipped %d database paths below --max-depth %d\n", deepPaths, config.MaxDepth)
+		}
+	}
+	stats.addTiming("build_unused_missing", time.Since(buildStart))
+
+	// A (nearly) empty result from the wrong database makes every file look
+	// unused, refuse to delete anything in that case
+	if removeUnused && len(filesMap) > 0 {
+		if len(unusedFiles)*100 > config.MaxUnusedRatio*len(filesMap) {
+			ratio := float64(len(unusedFiles)) * 100 / float64(len(filesMap))
+			fmt.Fprintf(stdout, "Error: Refusing to delete: %.1f%% of files are unused (--max-unused-ratio %d) — verify DB connection\n", ratio, config.MaxUnusedRatio)
+			return 1
+		}
+	}
+
+	// Path lists go to stdout below a heading, or without headings to
+	// --output-file, so they can be fed to other tools
+	separator := parseSeparator(*outputSeparator)
+	var listOut io.Writer
+	if *outputFile != "" && (listUnused || listMissing || listMissingFormatted || listMetadata || *format == "ndjson") {
+		f, err := os.Create(*outputFile)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error: Cannot create output file '%s': %v\n", *outputFile, err)
+			return 1
+		}
+		defer f.Close()
+
+		buffered := bufio.NewWriter(f)
+		defer buffered.Flush()
+		listOut = buffered
+	}
+
+	// --format ndjson writes every listed file and the summary as one JSON
+	// object per line, to --output-file or stdout
+	ndjsonOut := listOut
+	if ndjsonOut == nil {
+		ndjsonOut = stdout
+	}
+
+	// Process actions based on flags
+	if *topLargestUnused > 0 && !*countOnly && len(unusedFiles) > 0 {
+		largest := largestFiles(unusedFiles, filesMap, *topLargestUnused)
+		writePathTable(nil, fmt.Sprintf("Largest %d unused files:", len(largest)), largest, filesMap)
+	}
+
+	if listUnused {
+		if *format == "ndjson" {
+			writeNDJSONPaths(ndjsonOut, "unused", "", unusedFiles, filesMap)
+		} else if *compactUnused {
+			writeCompactPathList(listOut, "Unused files:", unusedFiles, filesMap)
+		} else if *format == "table" {
+			writePathTable(listOut, "Unused files:", unusedFiles, filesMap)
+		} else {
+			writePathList(listOut, "Unused files:", unusedFiles, separator)
+		}
+	}
+
+	if reportImportCandidates {
+		cutoff := time.Now().Add(-*importAge)
+		var candidates []string
+		for _, path := range unusedFiles {
+			if filesMap[path].ModTime.After(cutoff) && importNameRegexp.MatchString(filepath.Base(path)) {
+				candidates = append(candidates, path)
+			}
+		}
+		sort.Strings(candidates)
+		writePathTable(nil, fmt.Sprintf("Possible import files (unused, modified in the last %v):", *importAge), candidates, filesMap)
+		fmt.Fprintf(stdout, "Found %d possible import files, keep them with --min-age %v until the import is done\n", len(candidates), *importAge)
+	}
+
+	// With --check-writable the remove operations below skip the files of
+	// directories that fail a write test
+	var writable *writableDirs
+	if *checkWritable {
+		writable = &writableDirs{checked: make(map[string]bool)}
+	}
+
+	// Files removed by --remove-unused and --remove-duplicates, checked
+	// again with --verify-after-remove
+	var removedPaths []string
+
+	if removeUnused && !stopped {
+		fmt.Fprintln(stdout, "\nRemoving unused files...")
+
+		if config.MaxRemoveBytes > 0 {
+			// Smallest first removes the most files within the byte budget
+			sort.Slice(unusedFiles, func(i, j int) bool {
+				return filesMap[unusedFiles[i]].Size < filesMap[unusedFiles[j]].Size
+			})
+		}
+
+		var removedBytes int64
+		for i, path := range unusedFiles {
+			if config.MaxRemoveBytes > 0 && removedBytes+filesMap[path].Size > config.MaxRemoveBytes {
+				stats.RemainingUnused = int64(len(unusedFiles) - i)
+				fmt.Fprintf(stdout, "Reached --max-remove-bytes limit, %d unused files left\n", stats.RemainingUnused)
+				break
+			}
+
+			fullPath := filepath.Join(config.MediaPath, path)
+			if writable.skips(fullPath, stats) {
+				continue
+			}
+			info, err := os.Stat(fullPath)
+			if err == nil {
+				err = os.Remove(fullPath)
+			}
+			if err == nil {
+				removedBytes += info.Size()
+				removedPaths = append(removedPaths, fullPath)
+				atomic.AddInt64(&stats.RemovedUnused, 1)
+				atomic.AddInt64(&stats.BytesFreed, info.Size())
+				fmt.Fprintf(stdout, "Removed: %s\n", path)
+			} else if !os.IsNotExist(err) && fileOperationFailed(config, stats, err) {
+				if config.ExitOnFirstError {
+					return 1
+				}
+				stopped = true
+				break
+			}
+		}
+	}
+
+	if listMetadata && *format == "ndjson" {
+		writeNDJSONPaths(ndjsonOut, "metadata", "", scanResult.MetadataFiles, nil)
+	} else if listMetadata {
+		writePathList(listOut, "Metadata files:", scanResult.MetadataFiles, separator)
+	}
+
+	if config.CheckImageHeaders && len(scanResult.MismatchFiles) > 0 {
+		fmt.Fprintln(stdout, "\nFiles with mismatched image headers:")
+		for _, path := range scanResult.MismatchFiles {
+			fmt.Fprintf(stdout, "%s (%s content)\n", path, detectImageType(config.MediaPath+path))
+		}
+	}
+
+	if removeMetadata && !stopped {
+		fmt.Fprintln(stdout, "\nRemoving metadata files...")
+		for _, path := range scanResult.MetadataFiles {
+			fullPath := config.MediaPath + path
+			if writable.skips(fullPath, stats) {
+				continue
+			}
+			info, err := os.Stat(fullPath)
+			if err == nil {
+				err = os.Remove(fullPath)
+			}
+			if err == nil {
+				atomic.AddInt64(&stats.RemovedMetadata, 1)
+				atomic.AddInt64(&stats.BytesFreed, info.Size())
+				fmt.Fprintf(stdout, "Removed: %s\n", path)
+			} else if !os.IsNotExist(err) && fileOperationFailed(config, stats, err) {
+				if config.ExitOnFirstError {
+					return 1
+				}
+				stopped = true
+				break
+			}
+		}
+	}
+
+	if (listCachedOnly || removeCachedOnly) && !stopped {
+		orphanCache, err := findOrphanCacheFiles(config, filesMap)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(stdout, "Error scanning cache directory: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		}
+		stats.OrphanCacheFiles = int64(len(orphanCache))
+
+		if listCachedOnly && *format == "ndjson" {
+			writeNDJSONPaths(ndjsonOut, "cached_only", "", orphanCache, nil)
+		} else if listCachedOnly {
+			writePathList(listOut, "Cached images without source image:", orphanCache, separator)
+		}
+
+		if removeCachedOnly && !stopped {
+			fmt.Fprintln(stdout, "\nRemoving cached images without source image...")
+			for _, path := range orphanCache {
+				fullPath := config.MediaPath + path
+				if writable.skips(fullPath, stats) {
+					continue
+				}
+				info, err := os.Stat(fullPath)
+				if err == nil {
+					err = os.Remove(fullPath)
+				}
+				if err == nil {
+					atomic.AddInt64(&stats.RemovedOrphanCache, 1)
+					atomic.AddInt64(&stats.BytesFreed, info.Size())
+					fmt.Fprintf(stdout, "Removed: %s\n", path)
+				} else if !os.IsNotExist(err) && fileOperationFailed(config, stats, err) {
+					if config.ExitOnFirstError {
+						return 1
+					}
+					stopped = true
+					break
+				}
+			}
+		}
+	}
+
+	if includeSwatches && !stopped {
+		swatchDir := filepath.Join(config.MediaPath, "..", "..", "attribute", "swatch")
+		swatchFiles, err := scanImageDirectory(swatchDir, map[string]bool{"/swatch_image": true, "/swatch_thumb": true})
+		if err != nil {
+			fmt.Fprintf(stdout, "Error scanning swatch images: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		} else if usedSwatches, err := getSwatchImagePaths(catalog.ReadDB, config); err != nil {
+			fmt.Fprintf(stdout, "Error querying swatch images: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		} else {
+			stats.SwatchFiles = int64(len(swatchFiles))
+			stats.UnusedSwatches, stats.RemovedSwatches, stopped = cleanExtraMediaDir(config, stats, "swatch images",
+				swatchDir, swatchFiles, usedSwatches, listUnused, removeUnused, listOut, separator, *format, writable, &removedPaths)
+		}
+	}
+
+	if includeCustomerUpload && !stopped {
+		mediaRoot := filepath.Join(config.MediaPath, "..", "..")
+
+		customerDir := filepath.Join(mediaRoot, "customer")
+		customerFiles, err := scanImageDirectory(customerDir, nil)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(stdout, "Error scanning customer uploads: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		} else if usedCustomer, err := getCustomerImagePaths(db, config); err != nil {
+			fmt.Fprintf(stdout, "Error querying customer uploads: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		} else {
+			stats.CustomerFiles = int64(len(customerFiles))
+			stats.UnusedCustomerFiles, stats.RemovedCustomerFiles, stopped = cleanExtraMediaDir(config, stats, "customer uploads",
+				customerDir, customerFiles, usedCustomer, listUnused, removeUnused, listOut, separator, *format, writable, &removedPaths)
+		}
+
+		// Import images are referenced by gallery values below /import/
+		importDir := filepath.Join(mediaRoot, "import")
+		importFiles, err := scanImageDirectory(importDir, nil)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(stdout, "Error scanning import images: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		} else if !stopped {
+			usedImport := make(map[string]bool)
+			for path := range dbPathsMap {
+				if strings.HasPrefix(path, "/import/") {
+					usedImport[strings.TrimPrefix(path, "/import")] = true
+				}
+			}
+			stats.ImportFiles = int64(len(importFiles))
+			stats.UnusedImportFiles, stats.RemovedImportFiles, stopped = cleanExtraMediaDir(config, stats, "import images",
+				importDir, importFiles, usedImport, listUnused, removeUnused, listOut, separator, *format, writable, &removedPaths)
+		}
+	}
+
+	if stopped && config.ExitOnFirstError {
+		return 1
+	}
+
+	if listMissing {
+		if *format == "ndjson" {
+			writeNDJSONPaths(ndjsonOut, "missing", "", missingFiles, nil)
+		} else if *format == "table" {
+			writePathTable(listOut, "Missing files:", missingFiles, filesMap)
+		} else {
+			writePathList(listOut, "Missing files:", missingFiles, separator)
+		}
+	}
+
+	if listMissingFormatted {
+		if err := writeResizeCommands(listOut, catalog.ReadDB, config, missingFiles); err != nil {
+			fmt.Fprintf(stdout, "Error querying products with missing files: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		}
+	}
+
+	if perAttributeStats {
+		refs, err := getAttributeImagePaths(catalog.ReadDB, config)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error querying image attributes: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		} else {
+			printAttributeStats(refs, filesMap)
+		}
+	}
+
+	if reportAges {
+		printAgeDistribution(filesMap, unusedFiles)
+	}
+
+	if listBrokenRoleProducts {
+		products, err := getProductImageRoles(catalog.ReadDB, config)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error querying product image roles: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		} else {
+			printBrokenRoleProducts(products, filesMap)
+		}
+	}
+
+	// SKUs of products touched by cleanup operations, for --generate-import-script
+	modifiedSKUs := make(map[string]bool)
+
+	if removeOrphans && !stopped {
+		if *importScript != "" {
+			// Look up products before their gallery rows are deleted
+			if err := collectSKUsForPaths(catalog.ReadDB, config, missingFiles, modifiedSKUs); err != nil {
+				fmt.Fprintf(stdout, "Error looking up modified products: %v\n", err)
+				if operationFailed(config) {
+					return 1
+				}
+			}
+		}
+	}
+
+	if removeOrphans && !stopped {
+		fmt.Fprintln(stdout, "\nRemoving orphaned database rows...")
+		removed, err := removeOrphanedRows(catalog.DB, config, stats, missingFiles)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error removing orphaned rows: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		} else {
+			atomic.AddInt64(&stats.RemovedOrphans, removed)
+		}
+	}
+
+	if findDanglingLinks || removeDanglingLinks {
+		links, err := getDanglingLinks(catalog.ReadDB, config)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error querying dangling gallery links: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		} else {
+			stats.DanglingLinks = int64(len(links))
+			if findDanglingLinks {
+				fmt.Fprintln(stdout, "\nDangling gallery value links:")
+				for _, link := range links {
+					fmt.Fprintf(stdout, "value_id %d -> entity_id %d\n", link[0], link[1])
+				}
+			}
+		}
+
+		if removeDanglingLinks && !stopped && stats.DanglingLinks > 0 {
+			fmt.Fprintln(stdout, "\nRemoving dangling gallery value links...")
+			removed, err := removeDanglingGalleryLinks(catalog.DB, config)
+			if err != nil {
+				fmt.Fprintf(stdout, "Error removing dangling gallery links: %v\n", err)
+				if operationFailed(config) {
+					return 1
+				}
+			} else {
+				atomic.AddInt64(&stats.RemovedDanglingLinks, removed)
+			}
+		}
+	}
+
+	if fixNullGalleryValues && !stopped {
+		fmt.Fprintln(stdout, "\nDeleting media gallery rows with a NULL value...")
+		result, err := dbExec(catalog.DB, fmt.Sprintf("DELETE FROM %s WHERE value IS NULL",
+			config.DBTablePrefix+"catalog_product_entity_media_gallery"))
+		if err != nil {
+			fmt.Fprintf(stdout, "Error deleting NULL gallery rows: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		} else {
+			removed, _ := result.RowsAffected()
+			atomic.AddInt64(&stats.RemovedNullGallery, removed)
+		}
+	}
+
+	if removeEmptyGalleryValues && !stopped {
+		fmt.Fprintln(stdout, "\nDeleting media gallery rows with an empty value...")
+		result, err := dbExec(catalog.DB, fmt.Sprintf("DELETE FROM %s WHERE value = ''",
+			config.DBTablePrefix+"catalog_product_entity_media_gallery"))
+		if err != nil {
+			fmt.Fprintf(stdout, "Error deleting empty gallery rows: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		} else {
+			removed, _ := result.RowsAffected()
+			atomic.AddInt64(&stats.RemovedEmptyGallery, removed)
+		}
+	}
+
+	if fixGalleryOrdering && !stopped {
+		fmt.Fprintln(stdout, "\nRenumbering media gallery positions...")
+		reordered, err := fixGalleryPositions(catalog.DB, config)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error renumbering gallery positions: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		} else {
+			atomic.AddInt64(&stats.ReorderedGalleryRows, reordered)
+		}
+	}
+
+	if listDupes && *format == "ndjson" {
+		writeNDJSONDuplicates(ndjsonOut, hashMap)
+	} else if listDupes && *format == "table" {
+		writeDuplicateTable(hashMap)
+	} else if listDupes {
+		fmt.Fprintln(stdout, "\nDuplicate files:")
+		for key, files := range hashMap {
+			if len(files) > 1 {
+				fmt.Fprintf(stdout, "%s:\n", key)
+				for _, file := range files {
+					fmt.Fprintf(stdout, "  - %s\n", file.RelativePath)
+				}
+			}
+		}
+	}
+
+	if findMultiProductDupes {
+		var paths []string
+		for _, files := range hashMap {
+			if len(files) > 1 {
+				for _, file := range files {
+					paths = append(paths, file.RelativePath)
+				}
+			}
+		}
+
+		entities, err := getEntityIDsForPaths(catalog.ReadDB, config, paths)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error querying product assignments: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		} else {
+			printMultiProductDuplicates(hashMap, entities)
+		}
+	}
+
+	if reportDuplicateHistogram {
+		printDuplicateHistogram(hashMap)
+	}
+
+	if reportMimeDistribution {
+		printMimeDistribution(config, filesMap)
+	}
+
+	if detectSplitImages {
+		printSplitImages(splitImages, filesMap)
+	}
+
+	if reportPathEncoding {
+		printPathEncodingIssues(findPathEncodingIssues(filesMap), dbPathsMap)
+	}
+
+	if reportImageCountStats {
+		if err := printImageCountStats(catalog.ReadDB, config); err != nil {
+			fmt.Fprintf(stdout, "Error querying image counts: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		}
+	}
+
+	if reportVideoEntries {
+		external, local, err := printVideoEntries(catalog.ReadDB, config, missingFiles)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error querying video gallery entries: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		}
+		stats.ExternalVideoEntries, stats.LocalVideoEntries = external, local
+	}
+
+	if reportStoreSpecific {
+		count, err := printStoreSpecificImages(catalog.ReadDB, db, config)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error querying store specific images: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		}
+		stats.StoreSpecificImages = count
+	}
+
+	if reportAttributeSets {
+		if err := printAttributeSetBreakdown(catalog.ReadDB, config, unusedFiles, missingFiles); err != nil {
+			fmt.Fprintf(stdout, "Error querying attribute sets: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		}
+	}
+
+	if reportGalleryStats {
+		if err := printGalleryStats(catalog.ReadDB, config, *galleryImageThreshold); err != nil {
+			fmt.Fprintf(stdout, "Error querying gallery stats: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		}
+	}
+
+	if checkDuplicateProducts {
+		productImageSet, skus, err := getProductImageSets(catalog.ReadDB, config)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error querying product images: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		} else {
+			printDuplicateProducts(productImageSet, skus, hashMap)
+		}
+	}
+
+	if removeDupes && !stopped {
+		fmt.Fprintln(stdout, "\nRemoving duplicate files...")
+		duplicateStart := time.Now()
+
+		var groups [][]FileInfo
+		for _, files := range hashMap {
+			if len(files) > *keepDuplicates {
+				groups = append(groups, files)
+			}
+		}
+
+		if *sortByWaste {
+			// Largest (copies * size) first, so the most space is freed even
+			// if the run is interrupted
+			sort.Slice(groups, func(i, j int) bool {
+				return int64(len(groups[i])-*keepDuplicates)*groups[i][0].Size > int64(len(groups[j])-*keepDuplicates)*groups[j][0].Size
+			})
+		}
+
+		// Collect all duplicate mappings, the first --keep-N-duplicates
+		// files of each group are kept and still referenced as before
+		var allMappings []DuplicateMapping
+		for _, files := range groups {
+			original := files[0].RelativePath
+			for i := *keepDuplicates; i < len(files); i++ {
+				duplicate := files[i]
+				if protected[duplicate.RelativePath] {
+					continue
+				}
+				// Skipped before the database points it to the original
+				fullPath := filepath.Join(config.MediaPath, duplicate.RelativePath)
+				if writable.skips(fullPath, stats) {
+					continue
+				}
+				allMappings = append(allMappings, DuplicateMapping{
+					Original:  original,
+					Duplicate: duplicate.RelativePath,
+					FullPath:  fullPath,
+					Size:      duplicate.Size,
+				})
+			}
+		}
+
+		fmt.Fprintf(stdout, "Found %d duplicates to process\n", len(allMappings))
 
-		for i := 0; i < len(allMappings); i += batchSize {
+		// Process in batches of 5000
+		const batchSize = 5000
+		totalBatches := (len(allMappings) + batchSize - 1) / batchSize
+		var totalDelay time.Duration
+
+		for i := 0; i < len(allMappings) && !stopped; i += batchSize {
 			end := i + batchSize
 			if end > len(allMappings) {
 				end = len(allMappings)
@@ -420,386 +2133,4101 @@ func main() {
 			batch := allMappings[i:end]
 			batchNum := (i / batchSize) + 1
 
-			fmt.Printf("Processing batch %d/%d (%d duplicates)...\n", batchNum, totalBatches, len(batch))
+			if *batchDelay > 0 {
+				// Gives other queries a chance to take the locks
+				if batchNum > 1 {
+					time.Sleep(*batchDelay)
+					totalDelay += *batchDelay
+				}
+				fmt.Fprintf(stdout, "Processing batch %d/%d (%d duplicates, %v delay so far)...\n", batchNum, totalBatches, len(batch), totalDelay)
+			} else {
+				fmt.Fprintf(stdout, "Processing batch %d/%d (%d duplicates)...\n", batchNum, totalBatches, len(batch))
+			}
+
+			// Update database
+			batchStart := time.Now()
+			vUpdated, gUpdated, err := updateDatabaseForDuplicatesBatch(catalog.DB, config, batch)
+			stats.addTiming(fmt.Sprintf("update_duplicates_batch_%d", batchNum), time.Since(batchStart))
+			if err != nil {
+				fmt.Fprintf(stdout, "Error updating batch %d: %v\n", batchNum, err)
+				if operationFailed(config) {
+					return 1
+				}
+				continue // Skip file deletion for failed batch
+			}
+
+			// Delete files only after successful database update
+			// The database already points to the original, so a duplicate
+			// that could not be removed is only left over as an unused file
+			for _, mapping := range batch {
+				if err := os.Remove(mapping.FullPath); err == nil {
+					removedPaths = append(removedPaths, mapping.FullPath)
+					atomic.AddInt64(&stats.RemovedDuplicates, 1)
+					atomic.AddInt64(&stats.BytesFreed, mapping.Size)
+				} else if !os.IsNotExist(err) && fileOperationFailed(config, stats, err) {
+					if config.ExitOnFirstError {
+						return 1
+					}
+					stopped = true
+					break
+				}
+			}
+
+			atomic.AddInt64(&stats.UpdatedVarchar, vUpdated)
+			atomic.AddInt64(&stats.UpdatedGallery, gUpdated)
+
+			if *importScript != "" {
+				originals := make([]string, len(batch))
+				for j, mapping := range batch {
+					originals[j] = mapping.Original
+				}
+				if err := collectSKUsForPaths(catalog.ReadDB, config, originals, modifiedSKUs); err != nil {
+					fmt.Fprintf(stdout, "Error looking up modified products for batch %d: %v\n", batchNum, err)
+				}
+			}
+		}
+
+		duplicateDuration := time.Since(duplicateStart)
+		fmt.Fprintf(stdout, "\nDuplicate removal completed in %v\n", duplicateDuration.Round(time.Millisecond))
+	}
+
+	if *importScript != "" {
+		skus := make([]string, 0, len(modifiedSKUs))
+		for sku := range modifiedSKUs {
+			skus = append(skus, sku)
+		}
+		sort.Strings(skus)
+
+		if err := writeImportScript(*importScript, resolvedMagentoRoot, skus); err != nil {
+			fmt.Fprintf(stdout, "Error writing import script: %v\n", err)
+			if operationFailed(config) {
+				return 1
+			}
+		} else {
+			fmt.Fprintf(stdout, "\nImport script written to %s (%d modified products)\n", *importScript, len(skus))
+		}
+	}
+
+	if *verifyAfterRemove && len(removedPaths) > 0 {
+		fmt.Fprintf(stdout, "\nVerifying %d removed files...\n", len(removedPaths))
+		for _, path := range removedPaths {
+			if _, err := os.Lstat(path); !os.IsNotExist(err) {
+				stats.FailedRemovals++
+				fmt.Fprintf(stdout, "Warning: %s still exists after removal\n", path)
+			}
+		}
+	}
+
+	// Print summary
+	stats.GalleryEntries = len(dbPaths)
+	stats.ScanDuration = scanDuration
+	stats.DBDuration = dbDuration
+	stats.TotalDuration = time.Since(startTime)
+	if *countOnly {
+		writeCounts(stdout, stats, *format)
+	} else if *format == "ndjson" {
+		stats.Write(ndjsonOut, "ndjson")
+		if listOut != nil {
+			stats.Write(stdout, "text")
+		}
+	} else {
+		stats.Write(stdout, "text")
+		if *verbose {
+			stats.writeTimings(stdout)
+		}
+	}
+
+	if *statsOutput != "" {
+		statsFormat := "text"
+		switch strings.ToLower(filepath.Ext(*statsOutput)) {
+		case ".json":
+			statsFormat = "json"
+		case ".csv":
+			statsFormat = "csv"
+		}
+		f, err := os.Create(*statsOutput)
+		if err == nil {
+			err = stats.Write(f, statsFormat)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(stdout, "Error: Cannot write stats to '%s': %v\n", *statsOutput, err)
+			return 1
+		}
+	}
+
+	if stopped {
+		return 1
+	}
+	return 0
+}
+
+// cleanExtraMediaDir handles a media directory outside catalog/product: files
+// not in used are listed with list and removed with remove, guarded by
+// --max-unused-ratio and --check-writable. Removed files are added to
+// removedPaths for --verify-after-remove. It returns the number of unused and
+// removed files and whether a refused or failed removal stopped all further
+// cleanup.
+func cleanExtraMediaDir(config Config, stats *Stats, name, dir string, files map[string]int64, used map[string]bool,
+	list, remove bool, listOut io.Writer, separator, format string, writable *writableDirs, removedPaths *[]string) (int64, int64, bool) {
+	var unused []string
+	for path := range files {
+		if !used[path] {
+			unused = append(unused, path)
+		}
+	}
+	sort.Strings(unused)
+
+	if list && format == "ndjson" {
+		if listOut == nil {
+			listOut = stdout
+		}
+		sizes := make(map[string]FileInfo, len(unused))
+		for _, path := range unused {
+			sizes[path] = FileInfo{RelativePath: path, Size: files[path]}
+		}
+		writeNDJSONPaths(listOut, "unused", name, unused, sizes)
+	} else if list {
+		writePathList(listOut, "Unused "+name+":", unused, separator)
+	}
+	if !remove || len(unused) == 0 {
+		return int64(len(unused)), 0, false
+	}
+
+	if len(unused)*100 > config.MaxUnusedRatio*len(files) {
+		ratio := float64(len(unused)) * 100 / float64(len(files))
+		fmt.Fprintf(stdout, "Error: Refusing to delete %s: %.1f%% are unused (--max-unused-ratio %d) — verify DB connection\n",
+			name, ratio, config.MaxUnusedRatio)
+		return int64(len(unused)), 0, true
+	}
+
+	fmt.Fprintf(stdout, "\nRemoving unused %s...\n", name)
+	var removed int64
+	for _, path := range unused {
+		fullPath := filepath.Join(dir, path)
+		if writable.skips(fullPath, stats) {
+			continue
+		}
+		if err := os.Remove(fullPath); err == nil {
+			removed++
+			*removedPaths = append(*removedPaths, fullPath)
+			atomic.AddInt64(&stats.BytesFreed, files[path])
+			fmt.Fprintf(stdout, "Removed: %s\n", path)
+		} else if !os.IsNotExist(err) && fileOperationFailed(config, stats, err) {
+			return int64(len(unused)), removed, true
+		}
+	}
+	return int64(len(unused)), removed, false
+}
+
+// scanImageDirectory returns the size of every image below dir, keyed by its
+// path relative to dir with a leading slash. Directories in skipDirs (relative
+// paths as well) and OS metadata files are skipped.
+func scanImageDirectory(dir string, skipDirs map[string]bool) (map[string]int64, error) {
+	files := make(map[string]int64)
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath := filepath.ToSlash(strings.TrimPrefix(path, dir))
+		if entry.IsDir() {
+			if skipDirs[relPath] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isMetadataFile(entry.Name()) || !imageExts[strings.ToLower(filepath.Ext(entry.Name()))] {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		files[relPath] = info.Size()
+		return nil
+	})
+	return files, err
+}
+
+// findOrphanCacheFiles returns the images below cache/, relative to the media
+// path, whose source image is not in filesMap. Magento stores resized images
+// as cache/<params hash>/a/b/name.jpg (older versions add store, type and
+// size directories before the hash), the source is the last three parts.
+func findOrphanCacheFiles(config Config, filesMap map[string]FileInfo) ([]string, error) {
+	cacheFiles, err := scanImageDirectory(filepath.Join(config.MediaPath, "cache"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []string
+	for cachePath := range cacheFiles {
+		parts := strings.Split(strings.TrimPrefix(cachePath, "/"), "/")
+		if len(parts) < 2 {
+			continue
+		}
+		if len(parts) > 4 {
+			parts = parts[len(parts)-3:]
+		} else {
+			parts = parts[1:]
+		}
+
+		source := "/" + strings.Join(parts, "/")
+		if !matchesPathPrefix(config.OnlyPathPrefix, source, false) {
+			continue
+		}
+		if _, ok := filesMap[source]; !ok {
+			orphans = append(orphans, "/cache"+cachePath)
+		}
+	}
+	sort.Strings(orphans)
+	return orphans, nil
+}
+
+// writePathList writes paths, each followed by separator. A nil w means
+// stdout, where the list is preceded by heading.
+func writePathList(w io.Writer, heading string, paths []string, separator string) {
+	if w == nil {
+		fmt.Fprintln(stdout, "\n"+heading)
+		w = stdout
+	}
+	for _, path := range paths {
+		io.WriteString(w, path+separator)
+	}
+}
+
+// ndjsonRecord is a line of --format ndjson. Size is left out for files that
+// are not on disk, Directory names the media directory outside
+// catalog/product and Original the file a duplicate is a copy of.
+type ndjsonRecord struct {
+	Type      string `json:"type"`
+	Directory string `json:"directory,omitempty"`
+	Path      string `json:"path"`
+	Size      *int64 `json:"size,omitempty"`
+	Original  string `json:"original,omitempty"`
+}
+
+// writeNDJSONPaths writes one record of recordType per path, with the size
+// from filesMap if the path is in it
+func writeNDJSONPaths(w io.Writer, recordType, directory string, paths []string, filesMap map[string]FileInfo) {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, path := range paths {
+		record := ndjsonRecord{Type: recordType, Directory: directory, Path: path}
+		if info, ok := filesMap[path]; ok {
+			size := info.Size
+			record.Size = &size
+		}
+		enc.Encode(record)
+	}
+}
+
+// writeNDJSONDuplicates writes a "duplicate" record for every file of a
+// duplicate group but the first, whose path is the original
+func writeNDJSONDuplicates(w io.Writer, hashMap map[dedupeKey][]FileInfo) {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, files := range hashMap {
+		for _, file := range files[min(len(files), 1):] {
+			size := file.Size
+			enc.Encode(ndjsonRecord{Type: "duplicate", Path: file.RelativePath, Size: &size, Original: files[0].RelativePath})
+		}
+	}
+}
+
+// writePathTable writes paths with their size and modification time in
+// aligned columns. Files that are not on disk show "-". A nil w means stdout,
+// where the table is preceded by heading.
+func writePathTable(w io.Writer, heading string, paths []string, filesMap map[string]FileInfo) {
+	if w == nil {
+		fmt.Fprintln(stdout, "\n"+heading)
+		w = stdout
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tSIZE\tMODIFIED")
+	for _, path := range paths {
+		if fileInfo, exists := filesMap[path]; exists {
+			fmt.Fprintf(tw, "%s\t%d\t%s\n", path, fileInfo.Size, fileInfo.ModTime.Format("2006-01-02 15:04:05"))
+		} else {
+			fmt.Fprintf(tw, "%s\t-\t-\n", path)
+		}
+	}
+	tw.Flush()
+}
+
+// largestFiles returns the n largest of paths by size, largest first. It
+// keeps a min-heap of n entries instead of sorting all paths.
+func largestFiles(paths []string, filesMap map[string]FileInfo, n int) []string {
+	h := &sizeHeap{filesMap: filesMap}
+	for _, path := range paths {
+		if h.Len() < n {
+			heap.Push(h, path)
+		} else if filesMap[path].Size > filesMap[h.paths[0]].Size {
+			h.paths[0] = path
+			heap.Fix(h, 0)
+		}
+	}
+
+	largest := make([]string, h.Len())
+	for i := len(largest) - 1; i >= 0; i-- {
+		largest[i] = heap.Pop(h).(string)
+	}
+	return largest
+}
+
+// sizeHeap is a min-heap of paths ordered by file size
+type sizeHeap struct {
+	paths    []string
+	filesMap map[string]FileInfo
+}
+
+func (h *sizeHeap) Len() int { return len(h.paths) }
+func (h *sizeHeap) Less(i, j int) bool {
+	return h.filesMap[h.paths[i]].Size < h.filesMap[h.paths[j]].Size
+}
+func (h *sizeHeap) Swap(i, j int)      { h.paths[i], h.paths[j] = h.paths[j], h.paths[i] }
+func (h *sizeHeap) Push(x interface{}) { h.paths = append(h.paths, x.(string)) }
+func (h *sizeHeap) Pop() interface{} {
+	last := h.paths[len(h.paths)-1]
+	h.paths = h.paths[:len(h.paths)-1]
+	return last
+}
+
+// writeCompactPathList writes the number and total size of the paths per
+// directory of Magento's /x/y/ dispersion scheme. A nil w means stdout, where
+// the list is preceded by heading.
+func writeCompactPathList(w io.Writer, heading string, paths []string, filesMap map[string]FileInfo) {
+	if w == nil {
+		fmt.Fprintln(stdout, "\n"+heading)
+		w = stdout
+	}
+
+	counts := make(map[string]int)
+	sizes := make(map[string]int64)
+	for _, path := range paths {
+		group := "/"
+		if parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3); len(parts) == 3 {
+			group = "/" + parts[0] + "/" + parts[1] + "/"
+		}
+		counts[group]++
+		sizes[group] += filesMap[path].Size
+	}
+
+	groups := make([]string, 0, len(counts))
+	for group := range counts {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	for _, group := range groups {
+		fmt.Fprintf(w, "%s: %s files (%.1f MB)\n", group, formatCount(int64(counts[group])), float64(sizes[group])/1024/1024)
+	}
+}
+
+// formatCount formats n with thousands separators, e.g. 3,421
+func formatCount(n int64) string {
+	digits := strconv.FormatInt(n, 10)
+	if n < 0 {
+		return "-" + formatCount(-n)
+	}
+
+	var b strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(digit)
+	}
+	return b.String()
+}
+
+// writeDuplicateTable writes one row per duplicate group with the number of
+// files and the bytes wasted by the copies
+func writeDuplicateTable(hashMap map[dedupeKey][]FileInfo) {
+	fmt.Fprintln(stdout, "\nDuplicate files:")
+
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HASH\tFILES\tWASTED\tPATHS")
+	for key, files := range hashMap {
+		if len(files) < 2 {
+			continue
+		}
+
+		paths := make([]string, len(files))
+		for i, file := range files {
+			paths[i] = file.RelativePath
+		}
+		group := fmt.Sprintf("%016x", key.Hash)
+		if key.Name != "" {
+			group = key.String()
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", group, len(files), int64(len(files)-1)*files[0].Size, strings.Join(paths, ", "))
+	}
+	tw.Flush()
+}
+
+// parseSeparator resolves the \0, \n, \t and \\ escapes of --output-separator
+func parseSeparator(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\0`, "\x00", `\n`, "\n", `\t`, "\t").Replace(s)
+}
+
+// writableDirs remembers which directories passed the --check-writable test.
+// A nil *writableDirs skips nothing.
+type writableDirs struct {
+	checked map[string]bool
+}
+
+// skips reports whether the directory of fullPath is not writable and counts
+// the file as skipped. Every directory is tested once by creating and
+// removing a temporary file, a failing directory is reported once.
+func (w *writableDirs) skips(fullPath string, stats *Stats) bool {
+	if w == nil {
+		return false
+	}
+
+	dir := filepath.Dir(fullPath)
+	ok, tested := w.checked[dir]
+	if !tested {
+		f, err := os.CreateTemp(dir, ".media-cleaner-write-test-*")
+		if err == nil {
+			f.Close()
+			os.Remove(f.Name())
+		} else {
+			fmt.Fprintf(stdout, "Warning: %s is not writable, skipping its files: %v\n", dir, err)
+		}
+		ok = err == nil
+		w.checked[dir] = ok
+	}
+	if !ok {
+		atomic.AddInt64(&stats.SkippedUnwritable, 1)
+	}
+	return !ok
+}
+
+// fileOperationFailed reports a failed file operation. With --ignore-errors
+// the failure is logged to stderr and counted, and false is returned so the
+// caller continues. Otherwise a recovery suggestion is printed and true is
+// returned to stop all further cleanup.
+func fileOperationFailed(config Config, stats *Stats, err error) bool {
+	if config.IgnoreErrors {
+		atomic.AddInt64(&stats.FailedOperations, 1)
+		fmt.Fprintf(stderr, "Failed: %v\n", err)
+		return false
+	}
+
+	fmt.Fprintf(stdout, "Error: %v\n", err)
+	fmt.Fprintln(stdout, "Stopping cleanup. Fix the cause (e.g. file permissions) and run the command again,")
+	fmt.Fprintln(stdout, "or use --ignore-errors to skip files and directories that cannot be accessed.")
+	return true
+}
+
+// operationFailed reports whether the error just printed for a database
+// query, batch update or directory scan ends the run, which it only does
+// with --exit-on-first-error
+func operationFailed(config Config) bool {
+	if !config.ExitOnFirstError {
+		return false
+	}
+	fmt.Fprintln(stdout, "Exiting because of --exit-on-first-error.")
+	return true
+}
+
+// startMemorySampler records runtime.MemStats.HeapInuse every interval until
+// the returned function is called, which returns the highest value seen
+func startMemorySampler(interval time.Duration) func() int64 {
+	var peak int64
+	sample := func() {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		if int64(m.HeapInuse) > peak {
+			peak = int64(m.HeapInuse)
+		}
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sample()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() int64 {
+		close(done)
+		<-finished
+		sample()
+		return peak
+	}
+}
+
+// detectTablePrefix derives the table prefix from the name of the media
+// gallery table in information_schema. It fails if no table or more than one
+// candidate prefix is found.
+func detectTablePrefix(db *sql.DB, dbName string) (string, error) {
+	const suffix = "catalog_product_entity_media_gallery"
+
+	rows, err := dbQuery(db,
+		"SELECT TABLE_NAME FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_NAME LIKE ?",
+		dbName, "%"+escapeLike(suffix))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var candidates []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			continue
+		}
+		candidates = append(candidates, sanitizeTablePrefix(strings.TrimSuffix(name, suffix)))
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	switch len(candidates) {
+	case 0:
+		return "", fmt.Errorf("no %s table found in database '%s'", suffix, dbName)
+	case 1:
+		return candidates[0], nil
+	default:
+		quoted := make([]string, len(candidates))
+		for i, candidate := range candidates {
+			quoted[i] = "'" + candidate + "'"
+		}
+		return "", fmt.Errorf("multiple table prefixes found (%s), select one with --db-prefix", strings.Join(quoted, ", "))
+	}
+}
+
+// timestampWriter prefixes every line written to w with the current time.
+// It is safe for concurrent use.
+type timestampWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	midLine bool
+}
+
+func (t *timestampWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var buf bytes.Buffer
+	for rest := p; len(rest) > 0; {
+		if !t.midLine {
+			buf.WriteString(time.Now().Format("2006-01-02 15:04:05 "))
+			t.midLine = true
+		}
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			buf.Write(rest)
+			break
+		}
+		buf.Write(rest[:i+1])
+		rest = rest[i+1:]
+		t.midLine = false
+	}
+
+	if _, err := t.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// describeDB formats the connection target of config for display
+func describeDB(config Config) string {
+	if config.DBDSN != "" {
+		user, address, dbName := splitDSN(config.DBDSN)
+		return fmt.Sprintf("%s@%s/%s", user, address, dbName)
+	}
+	if config.DBSocket != "" {
+		return fmt.Sprintf("%s@unix(%s)/%s", config.DBUser, config.DBSocket, config.DBName)
+	}
+	return fmt.Sprintf("%s@%s:%s/%s", config.DBUser, config.DBHost, config.DBPort, config.DBName)
+}
+
+// splitDSN returns the user, the address and the database name of a MySQL
+// DSN in the user:pass@protocol(address)/dbname?params format, without the
+// password. Missing parts are returned empty.
+func splitDSN(dsn string) (user, address, dbName string) {
+	slash := strings.LastIndex(dsn, "/")
+	if slash < 0 {
+		return "", "", ""
+	}
+	dbName = dsn[slash+1:]
+	if i := strings.Index(dbName, "?"); i >= 0 {
+		dbName = dbName[:i]
+	}
+
+	address = dsn[:slash]
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		user = address[:at]
+		address = address[at+1:]
+	}
+	if colon := strings.Index(user, ":"); colon >= 0 {
+		user = user[:colon]
+	}
+	return user, address, dbName
+}
+
+// rotatingFile is an append-only log file that is renamed with a timestamp
+// suffix once it would grow beyond maxSize. Rotated files older than maxAge
+// are deleted. A zero maxSize disables rotation. It is not safe for
+// concurrent use on its own; timestampWriter serializes writes.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	f       *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	r.removeExpired()
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+
+	rotated := r.path + "." + time.Now().Format("20060102-150405.000")
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+	r.removeExpired()
+
+	return r.open()
+}
+
+// removeExpired deletes rotated log files older than maxAge
+func (r *rotatingFile) removeExpired() {
+	if r.maxAge <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-r.maxAge)
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.ModTime().Before(cutoff) {
+			os.Remove(match)
+		}
+	}
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
+
+// magentoSessionStmts are the session settings Magento's MySQL adapter uses,
+// run before the --db-init-stmt statements with --db-init-on-connect.
+// FOREIGN_KEY_CHECKS=0 is only used by Magento's setup and would skip the
+// cascading deletes --remove-orphans relies on.
+var magentoSessionStmts = []string{
+	"SET NAMES utf8mb4",
+	"SET SQL_MODE=''",
+}
+
+func connectDB(config Config) (*sql.DB, error) {
+	initStmts := config.DBInitStmts
+	if config.DBInitMagento {
+		initStmts = append(append([]string{}, magentoSessionStmts...), initStmts...)
+	}
+
+	if config.DBDSN != "" {
+		return openDB(config.DBDSN, initStmts)
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
+		config.DBUser, config.DBPass, config.DBHost, config.DBPort, config.DBName)
+	if config.DBSocket != "" {
+		dsn = fmt.Sprintf("%s:%s@unix(%s)/%s?parseTime=true",
+			config.DBUser, config.DBPass, config.DBSocket, config.DBName)
+	}
+	if config.DBReadTimeout > 0 {
+		dsn += "&readTimeout=" + config.DBReadTimeout.String()
+	}
+	if config.DBWriteTimeout > 0 {
+		dsn += "&writeTimeout=" + config.DBWriteTimeout.String()
+	}
+	if config.DBMaxPacket > 0 {
+		dsn += "&maxAllowedPacket=" + strconv.FormatInt(config.DBMaxPacket, 10)
+	}
+	if config.DBCollation != "" {
+		dsn += "&collation=" + config.DBCollation
+	}
+	if config.DBTimezone != "" {
+		// loc controls how parseTime interprets datetime values, the driver
+		// defaults to UTC
+		dsn += "&loc=" + url.QueryEscape(config.DBTimezone)
+	}
+	if config.DBTimezone != "" && config.DBTimezone != "Local" {
+		// time_zone is set as a session variable on every new connection by
+		// the driver, with Local the server default is kept
+		sessionZone := config.DBTimezone
+		if sessionZone == "UTC" {
+			// Works without the MySQL timezone tables being loaded
+			sessionZone = "+00:00"
+		}
+		dsn += "&time_zone=" + url.QueryEscape("'"+sessionZone+"'")
+	}
+
+	return openDB(dsn, initStmts)
+}
+
+// openDB opens a MySQL connection pool and checks that the server is
+// reachable. The initStmts run on every new connection of the pool, so
+// session variables hold for all queries.
+func openDB(dsn string, initStmts []string) (*sql.DB, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(initStmts) > 0 {
+		mysqlDriver := db.Driver()
+		db.Close()
+		db = sql.OpenDB(&initConnector{driver: mysqlDriver, dsn: dsn, stmts: initStmts})
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// initConnector opens connections with driver and runs stmts on each of them
+// before it is handed to the pool
+type initConnector struct {
+	driver driver.Driver
+	dsn    string
+	stmts  []string
+}
+
+func (c *initConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("driver does not support executing init statements")
+	}
+	for _, stmt := range c.stmts {
+		logSQL(stmt, nil)
+		if _, err := execer.ExecContext(ctx, stmt, nil); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("init statement %q: %w", stmt, err)
+		}
+	}
+	return conn, nil
+}
+
+func (c *initConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// stringList collects the values of a flag that can be given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, "; ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// printSQL enables logging of every SQL statement to stderr (--print-sql)
+var printSQL bool
+
+type sqlQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// dbQuery runs a query on a *sql.DB or *sql.Tx, logging it first if enabled
+func dbQuery(q sqlQueryer, query string, args ...interface{}) (*sql.Rows, error) {
+	logSQL(query, args)
+	return q.Query(query, args...)
+}
+
+// dbExec runs a statement on a *sql.DB or *sql.Tx, logging it first if enabled
+func dbExec(e sqlExecer, query string, args ...interface{}) (sql.Result, error) {
+	logSQL(query, args)
+	return e.Exec(query, args...)
+}
+
+type sqlRowQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// dbQueryRow runs a single row query on a *sql.DB or *sql.Tx, logging it first if enabled
+func dbQueryRow(q sqlRowQueryer, query string, args ...interface{}) *sql.Row {
+	logSQL(query, args)
+	return q.QueryRow(query, args...)
+}
+
+// logSQL prints the statement and its arguments to stderr. Long argument
+// lists and values are truncated to keep batch statements readable.
+func logSQL(query string, args []interface{}) {
+	if !printSQL {
+		return
+	}
+
+	const maxArgs = 20
+	const maxValueLen = 100
+
+	fmt.Fprintf(stderr, "SQL: %s\n", query)
+	if len(args) == 0 {
+		return
+	}
+
+	shown := args
+	if len(shown) > maxArgs {
+		shown = shown[:maxArgs]
+	}
+	values := make([]string, len(shown))
+	for i, arg := range shown {
+		value := fmt.Sprintf("%v", arg)
+		if len(value) > maxValueLen {
+			value = value[:maxValueLen] + "..."
+		}
+		values[i] = fmt.Sprintf("%q", value)
+	}
+	suffix := ""
+	if len(args) > maxArgs {
+		suffix = fmt.Sprintf(", ... (%d more)", len(args)-maxArgs)
+	}
+	fmt.Fprintf(stderr, "SQL args (%d): [%s%s]\n", len(args), strings.Join(values, ", "), suffix)
+}
+
+func scanFilesystem(config Config, stats *Stats) ScanResult {
+	// Channel for file paths
+	fileChan := make(chan string, 10000)
+
+	metaChan := make(chan string, 100)
+
+	// Start the pool of directory walkers
+	var walkerWg sync.WaitGroup
+	walkerWg.Add(1)
+	var walkDuration time.Duration
+	var overcrowded map[string]int
+	var walkStopped bool
+	go func() {
+		defer walkerWg.Done()
+		walkStart := time.Now()
+		overcrowded, walkStopped = walkDirectories(config, stats, fileChan, metaChan)
+		walkDuration = time.Since(walkStart)
+		close(fileChan)
+		close(metaChan)
+	}()
+
+	// Collect metadata files reported by the walker
+	var metadataFiles []string
+	metaDone := make(chan struct{})
+	go func() {
+		for path := range metaChan {
+			metadataFiles = append(metadataFiles, strings.TrimPrefix(path, config.MediaPath))
+		}
+		close(metaDone)
+	}()
+
+	// First pass: stat every file into worker-local maps using the stat pool
+	resultChan := make(chan map[string]FileInfo, config.WorkerCount)
+	var wg sync.WaitGroup
+
+	var mismatchMu sync.Mutex
+	var mismatchFiles []string
+
+	for i := 0; i < config.WorkerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			localFiles := make(map[string]FileInfo, 50000)
+
+			var statTime time.Duration
+			var localMismatches []string
+
+			for path := range fileChan {
+				start := time.Now()
+				if processFileLocal(path, config, stats, localFiles) {
+					localMismatches = append(localMismatches, strings.TrimPrefix(path, config.MediaPath))
+				}
+				statTime += time.Since(start)
+			}
+
+			if len(localMismatches) > 0 {
+				mismatchMu.Lock()
+				mismatchFiles = append(mismatchFiles, localMismatches...)
+				mismatchMu.Unlock()
+			}
+			atomic.AddInt64(&stats.StatNanos, int64(statTime))
+			resultChan <- localFiles
+		}()
+	}
+
+	// Wait for all workers to finish
+	go func() {
+		wg.Wait()
+		close(resultChan)
+	}()
+
+	// Wait for walkers to finish
+	walkerWg.Wait()
+	<-metaDone
+	stats.addTiming("walk", walkDuration)
+
+	// Merge all worker results and group paths by size
+	result := ScanResult{
+		FilesMap: make(map[string]FileInfo, 500000),
+		HashMap:  make(map[dedupeKey][]FileInfo, 100000),
+		SizeMap:  make(map[int64][]string, 100000),
+
+		MetadataFiles:   metadataFiles,
+		OvercrowdedDirs: overcrowded,
+		Stopped:         walkStopped,
+	}
+	atomic.AddInt64(&stats.MetadataFiles, int64(len(metadataFiles)))
+	atomic.AddInt64(&stats.OvercrowdedDirs, int64(len(overcrowded)))
+
+	for localFiles := range resultChan {
+		for path, fileInfo := range localFiles {
+			result.FilesMap[path] = fileInfo
+			result.SizeMap[fileInfo.Size] = append(result.SizeMap[fileInfo.Size], path)
+		}
+	}
+
+	// resultChan is closed once all stat workers are done
+	sort.Strings(mismatchFiles)
+	result.MismatchFiles = mismatchFiles
+	atomic.AddInt64(&stats.MismatchedHeaders, int64(len(mismatchFiles)))
+
+	// Second pass: the dedicated hash pool only hashes files that share their
+	// size with another file, files with a unique size cannot have a duplicate
+	hashChan := make(chan FileInfo, 10000)
+
+	// With --parallel-hash-strategy sequential-dir all workers hash the files
+	// of one directory before the next directory is started
+	var dirPending sync.WaitGroup
+	fileHashed := func() {}
+	if config.HashStrategy == "sequential-dir" {
+		fileHashed = dirPending.Done
+	}
+
+	go func() {
+		if config.NoHash {
+			close(hashChan)
+			return
+		}
+		if config.HashStrategy == "sequential-dir" {
+			dirs := make(map[string][]string)
+			for _, paths := range result.SizeMap {
+				if len(paths) > 1 {
+					for _, path := range paths {
+						dir := filepath.Dir(path)
+						dirs[dir] = append(dirs[dir], path)
+					}
+				}
+			}
+			names := make([]string, 0, len(dirs))
+			for dir := range dirs {
+				names = append(names, dir)
+			}
+			sort.Strings(names)
+			for _, dir := range names {
+				sort.Strings(dirs[dir])
+				dirPending.Add(len(dirs[dir]))
+				for _, path := range dirs[dir] {
+					hashChan <- result.FilesMap[path]
+				}
+				dirPending.Wait()
+			}
+			close(hashChan)
+			return
+		}
+		for _, paths := range result.SizeMap {
+			if len(paths) > 1 {
+				for _, path := range paths {
+					hashChan <- result.FilesMap[path]
+				}
+			}
+		}
+		close(hashChan)
+	}()
+
+	hashResultChan := make(chan []FileInfo, config.HashWorkers)
+	var hashWg sync.WaitGroup
+
+	for i := 0; i < config.HashWorkers; i++ {
+		hashWg.Add(1)
+		go func() {
+			defer hashWg.Done()
+			var hashed []FileInfo
+			var hashTime time.Duration
+			var hashedBytes int64
+
+			for fileInfo := range hashChan {
+				start := time.Now()
+				hash, err := hashFile(config.MediaPath+fileInfo.RelativePath, config.MmapThreshold)
+				hashTime += time.Since(start)
+				fileHashed()
+				if err != nil {
+					continue
+				}
+				atomic.AddInt64(&stats.HashedFiles, 1)
+				if fileInfo.Size > hashLimit {
+					hashedBytes += hashLimit
+				} else {
+					hashedBytes += fileInfo.Size
+				}
+				fileInfo.Hash = hash
+				hashed = append(hashed, fileInfo)
+			}
+
+			atomic.AddInt64(&stats.HashNanos, int64(hashTime))
+			atomic.AddInt64(&stats.HashedBytes, hashedBytes)
+			hashResultChan <- hashed
+		}()
+	}
+
+	go func() {
+		hashWg.Wait()
+		close(hashResultChan)
+	}()
+
+	for hashed := range hashResultChan {
+		for _, fileInfo := range hashed {
+			result.FilesMap[fileInfo.RelativePath] = fileInfo
+			if config.UniqueBy == "hash" || config.UniqueBy == "both" {
+				key := newDedupeKey(config.UniqueBy, fileInfo)
+				result.HashMap[key] = append(result.HashMap[key], fileInfo)
+			}
+		}
+	}
+
+	// Matching by file name alone also groups files whose size is unique,
+	// --no-hash groups all files by name and size
+	if config.UniqueBy == "path" || config.UniqueBy == "name-size" {
+		for _, fileInfo := range result.FilesMap {
+			key := newDedupeKey(config.UniqueBy, fileInfo)
+			result.HashMap[key] = append(result.HashMap[key], fileInfo)
+		}
+	}
+
+	// Count duplicates correctly (once per group, not per file)
+	for _, files := range result.HashMap {
+		if len(files) > 1 {
+			atomic.AddInt64(&stats.DuplicateFiles, int64(len(files)-1))
+		}
+	}
+
+	// Summed over all workers, so these can exceed the wall clock scan time
+	stats.addTiming("stat_all_workers", time.Duration(stats.StatNanos))
+	stats.addTiming("hash_all_workers", time.Duration(stats.HashNanos))
+
+	return result
+}
+
+// metadataFileNames are files created by operating systems and file managers
+// that never belong in the media directory
+var metadataFileNames = map[string]bool{
+	".DS_Store":   true,
+	"._.DS_Store": true,
+	".localized":  true,
+	"Thumbs.db":   true,
+	"ehthumbs.db": true,
+	"desktop.ini": true,
+	"Desktop.ini": true,
+}
+
+// isMetadataFile reports whether name is an OS metadata file. This includes
+// macOS AppleDouble files ("._image.jpg") which carry an image extension.
+func isMetadataFile(name string) bool {
+	return metadataFileNames[name] || strings.HasPrefix(name, "._")
+}
+
+// matchesPathPrefix reports whether a path relative to the media path falls
+// under --only-path-prefix. Directories match if they can contain such paths.
+func matchesPathPrefix(prefix, relPath string, isDir bool) bool {
+	if prefix == "" {
+		return true
+	}
+	if isDir {
+		dir := relPath + "/"
+		return strings.HasPrefix(prefix, dir) || strings.HasPrefix(dir, prefix)
+	}
+	return strings.HasPrefix(relPath, prefix)
+}
+
+// exceedsMaxDepth reports whether a path relative to the media path lies in
+// a directory that --max-depth keeps out of the scan
+func exceedsMaxDepth(maxDepth int, relPath string) bool {
+	if maxDepth <= 0 {
+		return false
+	}
+	return strings.Count(strings.Trim(relPath, "/"), "/")+1 > maxDepth
+}
+
+// imageExts are the file extensions treated as product images
+var imageExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+	".avif": true,
+}
+
+// walkItem is a directory queued for reading. The media path itself is at
+// depth 1, its subdirectories at depth 2 and so on.
+type walkItem struct {
+	path  string
+	depth int
+}
+
+// walkDirectories walks the tree below config.MediaPath with a pool of
+// config.WalkerCount goroutines, each reading one directory at a time and
+// re-enqueueing its subdirectories. Image files are sent to fileChan, OS
+// metadata files to metaChan. It returns once every directory has been read.
+func walkDirectories(config Config, stats *Stats, fileChan, metaChan chan<- string) (map[string]int, bool) {
+	dirChan := make(chan walkItem, 100)
+	var pending sync.WaitGroup
+
+	// Set once a directory could not be read, the remaining directories
+	// are skipped
+	var stopped atomic.Bool
+
+	// Directories above --max-files-per-dir
+	var overcrowdedMu sync.Mutex
+	overcrowded := make(map[string]int)
+
+	enqueue := func(item walkItem) {
+		pending.Add(1)
+		select {
+		case dirChan <- item:
+		default:
+			// Queue is full: hand off without blocking the walker, otherwise
+			// all walkers could end up waiting on each other
+			go func() { dirChan <- item }()
+		}
+	}
+
+	enqueue(walkItem{path: config.MediaPath, depth: 1})
+
+	var walkers sync.WaitGroup
+	for i := 0; i < config.WalkerCount; i++ {
+		walkers.Add(1)
+		go func() {
+			defer walkers.Done()
+			for item := range dirChan {
+				if stopped.Load() {
+					pending.Done()
+					continue
+				}
+				subdirs, files, stop := readDirectory(config, stats, item.path, fileChan, metaChan)
+				if stop {
+					stopped.Store(true)
+				}
+				if config.MaxFilesPerDir > 0 && files > config.MaxFilesPerDir {
+					overcrowdedMu.Lock()
+					overcrowded["/"+strings.TrimPrefix(strings.TrimPrefix(item.path, config.MediaPath), "/")] = files
+					overcrowdedMu.Unlock()
+				}
+				for _, subdir := range subdirs {
+					if config.MaxDepth > 0 && item.depth+1 > config.MaxDepth {
+						fmt.Fprintf(stdout, "Warning: Skipping %s (exceeds --max-depth %d)\n", subdir, config.MaxDepth)
+						continue
+					}
+					enqueue(walkItem{path: subdir, depth: item.depth + 1})
+				}
+				pending.Done()
+			}
+		}()
+	}
+
+	pending.Wait()
+	close(dirChan)
+	walkers.Wait()
+	return overcrowded, stopped.Load()
+}
+
+// readDirectory sends the files of a single directory to fileChan or metaChan
+// and returns its subdirectories, the number of other entries and whether a
+// failed read stopped the scan
+func readDirectory(config Config, stats *Stats, dir string, fileChan, metaChan chan<- string) ([]string, int, bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		// Removed while the scan was running
+		if os.IsNotExist(err) {
+			return nil, 0, false
+		}
+		return nil, 0, fileOperationFailed(config, stats, err)
+	}
+
+	var subdirs []string
+	files := 0
+	for _, entry := range entries {
+		fullPath := filepath.Join(dir, entry.Name())
+
+		if !matchesPathPrefix(config.OnlyPathPrefix, strings.TrimPrefix(fullPath, config.MediaPath), entry.IsDir()) {
+			continue
+		}
+
+		if !entry.IsDir() {
+			files++
+		}
+
+		if entry.IsDir() {
+			subdirs = append(subdirs, fullPath)
+		} else if isMetadataFile(entry.Name()) {
+			metaChan <- fullPath
+		} else {
+			// Only process image files
+			ext := strings.ToLower(filepath.Ext(entry.Name()))
+			if imageExts[ext] {
+				fileChan <- fullPath
+			}
+		}
+	}
+
+	return subdirs, files, false
+}
+
+// printOvercrowdedDirs warns about the directories above --max-files-per-dir,
+// the fullest first
+func printOvercrowdedDirs(dirs map[string]int, max int) {
+	paths := make([]string, 0, len(dirs))
+	for path := range dirs {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if dirs[paths[i]] != dirs[paths[j]] {
+			return dirs[paths[i]] > dirs[paths[j]]
+		}
+		return paths[i] < paths[j]
+	})
+	for _, path := range paths {
+		fmt.Fprintf(stdout, "Warning: %s contains %s files (--max-files-per-dir %d)\n", path, formatCount(int64(dirs[path])), max)
+	}
+}
+
+// processFileLocal stats a single file and records it in the worker-local
+// map. Hashing happens in a separate pass once all file sizes are known.
+// With --check-image-headers it returns true if the file is an image whose
+// magic bytes do not match its extension.
+func processFileLocal(fullPath string, config Config, stats *Stats, filesMap map[string]FileInfo) bool {
+	relPath := strings.TrimPrefix(fullPath, config.MediaPath)
+	if relPath == "" {
+		return false
+	}
+
+	// Skip cache directory
+	if strings.HasPrefix(relPath, "/cache/") || strings.HasPrefix(relPath, "cache/") {
+		atomic.AddInt64(&stats.CachedFiles, 1)
+		return false
+	}
+
+	// Watermarks are configured in core_config_data, not in the gallery
+	if config.WatermarkPath != "" && matchesWatermarkPath(config.WatermarkPath, relPath) {
+		atomic.AddInt64(&stats.WatermarkFiles, 1)
+		return false
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return false
+	}
+
+	fileInfo := FileInfo{
+		RelativePath: relPath,
+		Size:         info.Size(),
+		ModTime:      info.ModTime(),
+	}
+
+	// No mutex needed - worker-local maps
+	atomic.AddInt64(&stats.TotalFiles, 1)
+	filesMap[relPath] = fileInfo
+
+	if !config.CheckImageHeaders {
+		return false
+	}
+	expected, ok := imageExtensionTypes[strings.ToLower(filepath.Ext(relPath))]
+	if !ok {
+		return false
+	}
+	return detectImageType(fullPath) != expected
+}
+
+// matchesWatermarkPath reports whether relPath is below the directory
+// pattern, relative to the media path, or matches it as a glob pattern
+func matchesWatermarkPath(pattern, relPath string) bool {
+	relPath = strings.TrimPrefix(relPath, "/")
+	if strings.ContainsAny(pattern, "*?[") {
+		for dir := relPath; dir != "."; dir = path.Dir(dir) {
+			if matched, _ := path.Match(pattern, dir); matched {
+				return true
+			}
+		}
+		return false
+	}
+	return strings.HasPrefix(relPath, pattern+"/")
+}
+
+// imageExtensionTypes maps the extensions checked by --check-image-headers
+// to the type returned by detectImageType
+var imageExtensionTypes = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".png":  "png",
+	".gif":  "gif",
+	".webp": "webp",
+	".avif": "avif",
+}
+
+// detectImageType identifies an image by its magic bytes. It returns
+// "unknown" for anything else and for files that cannot be read.
+func detectImageType(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return "unknown"
+	}
+	defer f.Close()
+
+	// AVIF needs 12 bytes: a box size followed by "ftypavif" or "ftypavis"
+	header := make([]byte, 12)
+	n, _ := io.ReadFull(f, header)
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte("\xff\xd8\xff")):
+		return "jpeg"
+	case bytes.HasPrefix(header, []byte("\x89PNG")):
+		return "png"
+	case bytes.HasPrefix(header, []byte("GIF8")):
+		return "gif"
+	case len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WEBP":
+		return "webp"
+	case len(header) >= 12 && string(header[4:8]) == "ftyp" && (string(header[8:12]) == "avif" || string(header[8:12]) == "avis"):
+		return "avif"
+	}
+	return "unknown"
+}
+
+// duplicatesMap is the JSON document written by --export-duplicates-map
+type duplicatesMap struct {
+	MediaPath string               `json:"media_path"`
+	UniqueBy  string               `json:"unique_by"`
+	Groups    []duplicatesMapGroup `json:"groups"`
+}
+
+// duplicatesMapGroup holds the dedupeKey fields set for config.UniqueBy and
+// the files of the group, the first one is kept
+type duplicatesMapGroup struct {
+	Hash  string     `json:"hash,omitempty"`
+	Name  string     `json:"name,omitempty"`
+	Size  int64      `json:"size,omitempty"`
+	Files []FileInfo `json:"files"`
+}
+
+// fakeFile is an entry of the --fake-filesystem manifest. Files with the same
+// hash are duplicates, the hash is any string (an xxHash in hex is used as
+// is) and files without one have unique content.
+type fakeFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Hash    string    `json:"hash"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// readFakeFilesystem builds the scan result from a --fake-filesystem
+// manifest without touching any other file. Paths are relative to the media
+// path, cache and metadata files are counted like the scan does.
+func readFakeFilesystem(manifest string, config Config, stats *Stats) (ScanResult, error) {
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	var files []fakeFile
+	if err := json.Unmarshal(data, &files); err != nil {
+		return ScanResult{}, err
+	}
+
+	result := ScanResult{
+		FilesMap: make(map[string]FileInfo, len(files)),
+		HashMap:  make(map[dedupeKey][]FileInfo),
+		SizeMap:  make(map[int64][]string),
+	}
+	for _, file := range files {
+		relPath := "/" + strings.TrimPrefix(path.Clean("/"+file.Path), "/")
+		name := path.Base(relPath)
+		switch {
+		case isMetadataFile(name):
+			result.MetadataFiles = append(result.MetadataFiles, relPath)
+			continue
+		case !imageExts[strings.ToLower(path.Ext(name))], !matchesPathPrefix(config.OnlyPathPrefix, relPath, false), exceedsMaxDepth(config.MaxDepth, relPath):
+			continue
+		case strings.HasPrefix(relPath, "/cache/"):
+			stats.CachedFiles++
+			continue
+		case config.WatermarkPath != "" && matchesWatermarkPath(config.WatermarkPath, relPath):
+			stats.WatermarkFiles++
+			continue
+		}
+		if _, exists := result.FilesMap[relPath]; exists {
+			return ScanResult{}, fmt.Errorf("%s is listed more than once", relPath)
+		}
+
+		fileInfo := FileInfo{RelativePath: relPath, Size: file.Size, ModTime: file.ModTime}
+		if file.Hash != "" {
+			if fileInfo.Hash, err = strconv.ParseUint(file.Hash, 16, 64); err != nil {
+				fileInfo.Hash = xxhash.Sum64String(file.Hash)
+			}
+			stats.HashedFiles++
+		} else {
+			fileInfo.Hash = xxhash.Sum64String(relPath)
+		}
+
+		result.FilesMap[relPath] = fileInfo
+		result.SizeMap[file.Size] = append(result.SizeMap[file.Size], relPath)
+		key := newDedupeKey(config.UniqueBy, fileInfo)
+		result.HashMap[key] = append(result.HashMap[key], fileInfo)
+	}
+
+	for _, files := range result.HashMap {
+		if len(files) > 1 {
+			stats.DuplicateFiles += int64(len(files) - 1)
+		}
+	}
+	stats.TotalFiles = int64(len(result.FilesMap))
+	stats.MetadataFiles = int64(len(result.MetadataFiles))
+	sort.Strings(result.MetadataFiles)
+
+	return result, nil
+}
+
+// writeDuplicatesMap writes the groups of hashMap with more than one file to
+// path and returns the number of groups. Groups are ordered by the dedup
+// strategy, or by path without one.
+func writeDuplicatesMap(path string, config Config, hashMap map[dedupeKey][]FileInfo) (int, error) {
+	export := duplicatesMap{MediaPath: config.MediaPath, UniqueBy: config.UniqueBy, Groups: []duplicatesMapGroup{}}
+	for key, files := range hashMap {
+		if len(files) < 2 {
+			continue
+		}
+		sortDuplicateGroup(files, config.DedupStrategy)
+
+		group := duplicatesMapGroup{Name: key.Name, Size: key.Size, Files: files}
+		if key.Hash != 0 {
+			group.Hash = fmt.Sprintf("%016x", key.Hash)
+		}
+		export.Groups = append(export.Groups, group)
+	}
+	sort.Slice(export.Groups, func(i, j int) bool {
+		return export.Groups[i].Files[0].RelativePath < export.Groups[j].Files[0].RelativePath
+	})
+
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	return len(export.Groups), os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// readDuplicatesMap loads a file written by writeDuplicatesMap in place of a
+// scan. Files that no longer exist or changed size are dropped, as are groups
+// left with a single file.
+func readDuplicatesMap(path string, config Config, stats *Stats) (ScanResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	var imported duplicatesMap
+	if err := json.Unmarshal(data, &imported); err != nil {
+		return ScanResult{}, err
+	}
+	if imported.MediaPath != config.MediaPath {
+		return ScanResult{}, fmt.Errorf("exported for media path %s, not %s", imported.MediaPath, config.MediaPath)
+	}
+
+	result := ScanResult{
+		FilesMap: make(map[string]FileInfo),
+		HashMap:  make(map[dedupeKey][]FileInfo, len(imported.Groups)),
+		SizeMap:  make(map[int64][]string),
+	}
+	for _, group := range imported.Groups {
+		key := dedupeKey{Name: group.Name, Size: group.Size}
+		if group.Hash != "" {
+			if key.Hash, err = strconv.ParseUint(group.Hash, 16, 64); err != nil {
+				return ScanResult{}, fmt.Errorf("invalid hash %q", group.Hash)
+			}
+		}
+
+		var files []FileInfo
+		for _, file := range group.Files {
+			info, err := os.Stat(config.MediaPath + file.RelativePath)
+			if err != nil || info.Size() != file.Size {
+				fmt.Fprintf(stdout, "Warning: %s no longer exists or changed, skipped\n", file.RelativePath)
+				continue
+			}
+			file.Hash = key.Hash
+			file.ModTime = info.ModTime()
+			files = append(files, file)
+		}
+		if len(files) < 2 {
+			continue
+		}
+
+		for _, file := range files {
+			// A path in several groups could be removed as a duplicate of a
+			// file that is removed itself
+			if _, exists := result.FilesMap[file.RelativePath]; exists {
+				return ScanResult{}, fmt.Errorf("%s is listed in more than one group", file.RelativePath)
+			}
+			result.FilesMap[file.RelativePath] = file
+			result.SizeMap[file.Size] = append(result.SizeMap[file.Size], file.RelativePath)
+		}
+		result.HashMap[key] = files
+		atomic.AddInt64(&stats.DuplicateFiles, int64(len(files)-1))
+	}
+	atomic.AddInt64(&stats.TotalFiles, int64(len(result.FilesMap)))
+
+	return result, nil
+}
+
+// sortDuplicateGroup orders files so that the copy to keep according to the
+// dedup strategy is at index 0. Ties are broken by path for stable results.
+func sortDuplicateGroup(files []FileInfo, strategy string) {
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		switch strategy {
+		case "keep-largest":
+			if a.Size != b.Size {
+				return a.Size > b.Size
+			}
+		case "keep-smallest":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "keep-oldest":
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		case "keep-newest":
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.After(b.ModTime)
+			}
+		}
+		return a.RelativePath < b.RelativePath
+	})
+}
+
+// hashLimit is the number of bytes hashed per file. Hash only the first 4 MB
+// for performance.
+const hashLimit = 4 << 20
+
+// hashFile hashes the first hashLimit bytes of a file. Files smaller than
+// mmapThreshold are memory-mapped where supported, everything else is
+// streamed through a reader.
+func hashFile(path string, mmapThreshold int64) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if mmapThreshold > 0 {
+		if info, err := f.Stat(); err == nil && info.Size() < mmapThreshold {
+			if hash, ok := hashFileMmap(f, info.Size()); ok {
+				return hash, nil
+			}
+		}
+	}
+
+	h := xxhash.New()
+	limitedReader := io.LimitReader(f, hashLimit)
+	if _, err := io.Copy(h, limitedReader); err != nil {
+		return 0, err
+	}
+
+	return h.Sum64(), nil
+}
+
+// getMediaGalleryPaths returns the values of the media gallery and the
+// distinct image paths of the image role attributes
+func getMediaGalleryPaths(db *sql.DB, config Config, stats *Stats) ([]string, []string, error) {
+	galleryPaths, err := getGalleryValues(db, config, stats)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	varcharPaths, err := getVarcharImagePaths(db, config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return galleryPaths, varcharPaths, nil
+}
+
+// getGalleryValues returns all values of catalog_product_entity_media_gallery
+// below --only-path-prefix. NULL values are skipped and counted in stats.
+func getGalleryValues(db *sql.DB, config Config, stats *Stats) ([]string, error) {
+	tableName := config.DBTablePrefix + "catalog_product_entity_media_gallery"
+	query := fmt.Sprintf("SELECT value FROM %s", tableName)
+
+	var args []interface{}
+	if config.OnlyPathPrefix != "" {
+		query += " WHERE value LIKE ?"
+		args = append(args, escapeLike(config.OnlyPathPrefix)+"%")
+	}
+
+	rows, err := dbQuery(db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var value sql.NullString
+		if err := rows.Scan(&value); err != nil {
+			continue
+		}
+		if !value.Valid {
+			atomic.AddInt64(&stats.NullGalleryValues, 1)
+			continue
+		}
+		if value.String == "" {
+			atomic.AddInt64(&stats.EmptyGalleryValues, 1)
+			continue
+		}
+		paths = append(paths, value.String)
+	}
+
+	// A result cut off by --db-read-timeout ends the loop early, the missing
+	// paths would make their files look unused
+	return paths, rows.Err()
+}
+
+// imageRoleAttributes are the product attributes holding image paths in
+// catalog_product_entity_varchar
+var imageRoleAttributes = []string{"image", "small_image", "thumbnail", "swatch_image"}
+
+// imageRoleCondition returns the condition matching the image role attributes
+// on eav_attribute a and its arguments
+func imageRoleCondition() (string, []interface{}) {
+	placeholders := make([]string, len(imageRoleAttributes))
+	args := make([]interface{}, len(imageRoleAttributes))
+	for i, code := range imageRoleAttributes {
+		placeholders[i] = "?"
+		args[i] = code
+	}
+	return "a.attribute_code IN (" + strings.Join(placeholders, ",") + ")", args
+}
+
+// getVarcharImagePaths returns the distinct image paths referenced by any
+// image role attribute below --only-path-prefix
+func getVarcharImagePaths(db *sql.DB, config Config) ([]string, error) {
+	varcharTable := config.DBTablePrefix + "catalog_product_entity_varchar"
+	attributeTable := config.DBTablePrefix + "eav_attribute"
+
+	roleCondition, args := imageRoleCondition()
+
+	query := fmt.Sprintf(
+		"SELECT DISTINCT v.value FROM %s v "+
+			"JOIN %s a ON a.attribute_id = v.attribute_id "+
+			"WHERE %s AND v.value IS NOT NULL AND v.value != 'no_selection'",
+		varcharTable, attributeTable, roleCondition)
+	if config.OnlyPathPrefix != "" {
+		query += " AND v.value LIKE ?"
+		args = append(args, escapeLike(config.OnlyPathPrefix)+"%")
+	}
+
+	rows, err := dbQuery(db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			continue
+		}
+		paths = append(paths, value)
+	}
+
+	return paths, rows.Err()
+}
+
+// insertGalleryRowsForVarchar adds a media gallery entry, linked to every
+// product referencing it through an image role attribute, for each path.
+// All rows are inserted in one transaction. Paths without a product are
+// reported and skipped.
+func insertGalleryRowsForVarchar(conn DBConn, config Config, paths []string) (int64, error) {
+	if len(paths) == 0 {
+		return 0, nil
+	}
+
+	varcharTable := config.DBTablePrefix + "catalog_product_entity_varchar"
+	attributeTable := config.DBTablePrefix + "eav_attribute"
+
+	galleryAttributeID, err := getMediaGalleryAttributeID(conn.ReadDB, config)
+	if err != nil {
+		return 0, err
+	}
+
+	// Products referencing each path
+	entities := make(map[string][]int64, len(paths))
+	const batchSize = 5000
+	for i := 0; i < len(paths); i += batchSize {
+		end := i + batchSize
+		if end > len(paths) {
+			end = len(paths)
+		}
+
+		batch := paths[i:end]
+		roleCondition, args := imageRoleCondition()
+		placeholders := make([]string, len(batch))
+		// With a case insensitive collation (the column default or
+		// --db-collation) MySQL returns the stored value, which can differ
+		// in case from the path that matched it
+		exact := make(map[string]bool, len(batch))
+		byFolded := make(map[string][]string, len(batch))
+		for j, path := range batch {
+			placeholders[j] = "?"
+			args = append(args, path)
+			exact[path] = true
+			folded := strings.ToLower(path)
+			byFolded[folded] = append(byFolded[folded], path)
+		}
+
+		query := fmt.Sprintf(
+			"SELECT DISTINCT v.value, v.entity_id FROM %s v JOIN %s a ON a.attribute_id = v.attribute_id "+
+				"WHERE %s AND v.value%s IN (%s)",
+			varcharTable, attributeTable, roleCondition, collateClause(config), strings.Join(placeholders, ","))
+
+		rows, err := dbQuery(conn.ReadDB, query, args...)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			var value string
+			var entityID int64
+			if err := rows.Scan(&value, &entityID); err != nil {
+				continue
+			}
+			if exact[value] {
+				entities[value] = append(entities[value], entityID)
+				continue
+			}
+			for _, path := range byFolded[strings.ToLower(value)] {
+				entities[path] = append(entities[path], entityID)
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Matched by other collation rules (e.g. accents) or no longer referenced
+	var unmatched []string
+	for _, path := range paths {
+		if len(entities[path]) == 0 {
+			unmatched = append(unmatched, path)
+		}
+	}
+	if len(unmatched) > 0 {
+		const examples = 10
+		fmt.Fprintf(stdout, "Warning: No product found for %d paths, no gallery row added for them:\n", len(unmatched))
+		for i, path := range unmatched {
+			if i == examples {
+				fmt.Fprintf(stdout, "... and %d more\n", len(unmatched)-examples)
+				break
+			}
+			fmt.Fprintf(stdout, "  %s\n", path)
+		}
+	}
+
+	tx, err := conn.DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback() // Rollback if not committed
+
+	var inserted int64
+	for _, path := range paths {
+		if len(entities[path]) == 0 {
+			continue
+		}
+		if err := insertGalleryRow(tx, config, galleryAttributeID, path, entities[path]); err != nil {
+			return 0, err
+		}
+		inserted++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return inserted, nil
+}
+
+// getMediaGalleryAttributeID returns the attribute_id of the media_gallery
+// product attribute
+func getMediaGalleryAttributeID(db *sql.DB, config Config) (int64, error) {
+	attributeTable := config.DBTablePrefix + "eav_attribute"
+	entityTypeTable := config.DBTablePrefix + "eav_entity_type"
+
+	var galleryAttributeID int64
+	rows, err := dbQuery(db, fmt.Sprintf(
+		"SELECT a.attribute_id FROM %s a JOIN %s t ON t.entity_type_id = a.entity_type_id "+
+			"WHERE a.attribute_code = 'media_gallery' AND t.entity_type_code = 'catalog_product'",
+		attributeTable, entityTypeTable))
+	if err != nil {
+		return 0, err
+	}
+	if rows.Next() {
+		err = rows.Scan(&galleryAttributeID)
+	} else {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+	if galleryAttributeID == 0 {
+		return 0, fmt.Errorf("media_gallery attribute not found")
+	}
+	return galleryAttributeID, nil
+}
+
+// insertGalleryRow adds path to the gallery of the given products, enabled
+// in the default store view
+func insertGalleryRow(tx *sql.Tx, config Config, galleryAttributeID int64, path string, entityIDs []int64) error {
+	galleryTable := config.DBTablePrefix + "catalog_product_entity_media_gallery"
+	valueTable := config.DBTablePrefix + "catalog_product_entity_media_gallery_value"
+	linkTable := config.DBTablePrefix + "catalog_product_entity_media_gallery_value_to_entity"
+
+	result, err := dbExec(tx, fmt.Sprintf(
+		"INSERT INTO %s (attribute_id, value, media_type, disabled) VALUES (?, ?, 'image', 0)", galleryTable),
+		galleryAttributeID, path)
+	if err != nil {
+		return fmt.Errorf("failed to insert gallery row for %s: %v", path, err)
+	}
+	valueID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for _, entityID := range entityIDs {
+		if _, err := dbExec(tx, fmt.Sprintf("INSERT INTO %s (value_id, entity_id) VALUES (?, ?)", linkTable),
+			valueID, entityID); err != nil {
+			return fmt.Errorf("failed to link gallery row for %s: %v", path, err)
+		}
+		if _, err := dbExec(tx, fmt.Sprintf("INSERT INTO %s (value_id, store_id, entity_id, disabled) VALUES (?, 0, ?, 0)", valueTable),
+			valueID, entityID); err != nil {
+			return fmt.Errorf("failed to insert gallery value for %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// VarcharRoleImage is an image role value of a product without a gallery
+// row for the same image linked to that product
+type VarcharRoleImage struct {
+	EntityID      int64
+	SKU           string
+	AttributeCode string
+	Path          string
+}
+
+// getVarcharWithoutGallery returns the image role values in
+// catalog_product_entity_varchar whose product has no gallery entry with the
+// same value. Magento shows such images on the product page but not in the
+// gallery.
+func getVarcharWithoutGallery(db *sql.DB, config Config) ([]VarcharRoleImage, error) {
+	varcharTable := config.DBTablePrefix + "catalog_product_entity_varchar"
+	attributeTable := config.DBTablePrefix + "eav_attribute"
+	productTable := config.DBTablePrefix + "catalog_product_entity"
+	galleryTable := config.DBTablePrefix + "catalog_product_entity_media_gallery"
+	linkTable := config.DBTablePrefix + "catalog_product_entity_media_gallery_value_to_entity"
+
+	roleCondition, args := imageRoleCondition()
+
+	query := fmt.Sprintf(
+		"SELECT DISTINCT v.entity_id, p.sku, a.attribute_code, v.value FROM %s v "+
+			"JOIN %s a ON a.attribute_id = v.attribute_id "+
+			"JOIN %s p ON p.entity_id = v.entity_id "+
+			"WHERE %s AND v.value IS NOT NULL AND v.value != 'no_selection' "+
+			"AND NOT EXISTS (SELECT 1 FROM %s g JOIN %s l ON l.value_id = g.value_id "+
+			"WHERE g.value = v.value AND l.entity_id = v.entity_id) "+
+			"ORDER BY p.sku, a.attribute_code",
+		varcharTable, attributeTable, productTable, roleCondition, galleryTable, linkTable)
+
+	rows, err := dbQuery(db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []VarcharRoleImage
+	for rows.Next() {
+		var image VarcharRoleImage
+		if err := rows.Scan(&image.EntityID, &image.SKU, &image.AttributeCode, &image.Path); err != nil {
+			continue
+		}
+		images = append(images, image)
+	}
+
+	return images, rows.Err()
+}
+
+// insertGalleryRowsForProducts adds one gallery row per path and product of
+// images, a product with the same path in several roles gets a single row
+func insertGalleryRowsForProducts(conn DBConn, config Config, images []VarcharRoleImage) (int64, error) {
+	if len(images) == 0 {
+		return 0, nil
+	}
+
+	galleryAttributeID, err := getMediaGalleryAttributeID(conn.ReadDB, config)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := conn.DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback() // Rollback if not committed
+
+	var inserted int64
+	seen := make(map[VarcharRoleImage]bool, len(images))
+	for _, image := range images {
+		key := VarcharRoleImage{EntityID: image.EntityID, Path: image.Path}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if err := insertGalleryRow(tx, config, galleryAttributeID, image.Path, []int64{image.EntityID}); err != nil {
+			return 0, err
+		}
+		inserted++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return inserted, nil
+}
+
+// getAttributeImagePaths returns the distinct image paths referenced per image
+// role attribute code in catalog_product_entity_varchar
+func getAttributeImagePaths(db *sql.DB, config Config) (map[string][]string, error) {
+	varcharTable := config.DBTablePrefix + "catalog_product_entity_varchar"
+	attributeTable := config.DBTablePrefix + "eav_attribute"
+
+	roleCondition, args := imageRoleCondition()
+
+	query := fmt.Sprintf(
+		"SELECT DISTINCT a.attribute_code, v.value FROM %s v "+
+			"JOIN %s a ON a.attribute_id = v.attribute_id "+
+			"WHERE %s AND v.value IS NOT NULL AND v.value != 'no_selection'",
+		varcharTable, attributeTable, roleCondition)
+
+	rows, err := dbQuery(db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := make(map[string][]string, len(imageRoleAttributes))
+	for rows.Next() {
+		var code, value string
+		if err := rows.Scan(&code, &value); err != nil {
+			continue
+		}
+		refs[code] = append(refs[code], value)
+	}
+
+	return refs, rows.Err()
+}
+
+func printAttributeStats(refs map[string][]string, filesMap map[string]FileInfo) {
+	fmt.Fprintln(stdout, "\nImage references per attribute:")
+	fmt.Fprintf(stdout, "%-15s | %10s | %12s\n", "attribute_code", "total_refs", "missing_refs")
+	fmt.Fprintln(stdout, strings.Repeat("-", 43))
+	for _, code := range imageRoleAttributes {
+		missing := 0
+		for _, path := range refs[code] {
+			if _, exists := filesMap[path]; !exists {
+				missing++
+			}
+		}
+		fmt.Fprintf(stdout, "%-15s | %10d | %12d\n", code, len(refs[code]), missing)
+	}
+}
+
+// ProductImageRoles holds the image role values assigned to a single product
+type ProductImageRoles struct {
+	EntityID int64
+	SKU      string
+	Roles    map[string][]string
+}
+
+// getProductImageRoles returns the image role values of every product that has
+// at least one image role assigned, ordered by entity_id
+func getProductImageRoles(db *sql.DB, config Config) ([]*ProductImageRoles, error) {
+	varcharTable := config.DBTablePrefix + "catalog_product_entity_varchar"
+	attributeTable := config.DBTablePrefix + "eav_attribute"
+	productTable := config.DBTablePrefix + "catalog_product_entity"
+
+	roleCondition, args := imageRoleCondition()
+
+	query := fmt.Sprintf(
+		"SELECT v.entity_id, e.sku, a.attribute_code, v.value FROM %s v "+
+			"JOIN %s a ON a.attribute_id = v.attribute_id "+
+			"JOIN %s e ON e.entity_id = v.entity_id "+
+			"WHERE %s AND v.value IS NOT NULL AND v.value != 'no_selection' "+
+			"ORDER BY v.entity_id",
+		varcharTable, attributeTable, productTable, roleCondition)
+
+	rows, err := dbQuery(db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var products []*ProductImageRoles
+	for rows.Next() {
+		var entityID int64
+		var sku, code, value string
+		if err := rows.Scan(&entityID, &sku, &code, &value); err != nil {
+			continue
+		}
+		if len(products) == 0 || products[len(products)-1].EntityID != entityID {
+			products = append(products, &ProductImageRoles{
+				EntityID: entityID,
+				SKU:      sku,
+				Roles:    make(map[string][]string),
+			})
+		}
+		product := products[len(products)-1]
+		product.Roles[code] = append(product.Roles[code], value)
+	}
+
+	return products, rows.Err()
+}
+
+// printBrokenRoleProducts lists products where every assigned image role
+// points to a file that does not exist on disk
+func printBrokenRoleProducts(products []*ProductImageRoles, filesMap map[string]FileInfo) {
+	fmt.Fprintln(stdout, "\nProducts with all image roles missing:")
+	count := 0
+	for _, product := range products {
+		var brokenRoles []string
+		allMissing := true
+		for _, code := range imageRoleAttributes {
+			values, assigned := product.Roles[code]
+			if !assigned {
+				continue
+			}
+			for _, value := range values {
+				if _, exists := filesMap[value]; exists {
+					allMissing = false
+				}
+			}
+			brokenRoles = append(brokenRoles, code)
+		}
+		if !allMissing {
+			continue
+		}
+		count++
+		fmt.Fprintf(stdout, "%d\t%s\t%s\n", product.EntityID, product.SKU, strings.Join(brokenRoles, ","))
+	}
+	fmt.Fprintf(stdout, "Found %d products without a single existing role image\n", count)
+}
+
+// escapeLike escapes the LIKE wildcards in s so it is matched literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// getDanglingLinks returns the (value_id, entity_id) pairs of
+// catalog_product_entity_media_gallery_value_to_entity whose product does not
+// exist in catalog_product_entity
+func getDanglingLinks(db *sql.DB, config Config) ([][2]int64, error) {
+	linkTable := config.DBTablePrefix + "catalog_product_entity_media_gallery_value_to_entity"
+	productTable := config.DBTablePrefix + "catalog_product_entity"
+
+	rows, err := dbQuery(db, fmt.Sprintf(
+		"SELECT l.value_id, l.entity_id FROM %s l LEFT JOIN %s e ON e.entity_id = l.entity_id "+
+			"WHERE e.entity_id IS NULL ORDER BY l.entity_id, l.value_id",
+		linkTable, productTable))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links [][2]int64
+	for rows.Next() {
+		var link [2]int64
+		if err := rows.Scan(&link[0], &link[1]); err != nil {
+			continue
+		}
+		links = append(links, link)
+	}
+
+	return links, rows.Err()
+}
+
+// removeDanglingGalleryLinks deletes the rows returned by getDanglingLinks
+func removeDanglingGalleryLinks(db *sql.DB, config Config) (int64, error) {
+	linkTable := config.DBTablePrefix + "catalog_product_entity_media_gallery_value_to_entity"
+	productTable := config.DBTablePrefix + "catalog_product_entity"
+
+	result, err := dbExec(db, fmt.Sprintf(
+		"DELETE l FROM %s l LEFT JOIN %s e ON e.entity_id = l.entity_id WHERE e.entity_id IS NULL",
+		linkTable, productTable))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// fixGalleryPositions renumbers the positions in
+// catalog_product_entity_media_gallery_value to 1..n per product and store
+// view, keeping their order. Requires window functions (MySQL 8, MariaDB 10.2).
+func fixGalleryPositions(db *sql.DB, config Config) (int64, error) {
+	valueTable := config.DBTablePrefix + "catalog_product_entity_media_gallery_value"
+
+	query := fmt.Sprintf(
+		"UPDATE %s v JOIN (SELECT record_id, ROW_NUMBER() OVER "+
+			"(PARTITION BY entity_id, store_id ORDER BY position IS NULL, position, record_id) AS new_position "+
+			"FROM %s) r ON r.record_id = v.record_id "+
+			"SET v.position = r.new_position WHERE v.position IS NULL OR v.position != r.new_position",
+		valueTable, valueTable)
+
+	result, err := dbExec(db, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func removeOrphanedRows(db *sql.DB, config Config, stats *Stats, missingFiles []string) (int64, error) {
+	if len(missingFiles) == 0 {
+		return 0, nil
+	}
+
+	tableName := config.DBTablePrefix + "catalog_product_entity_media_gallery"
+
+	// Process in batches to avoid "too many placeholders" error
+	// MySQL max placeholders is 65535, use 5000 for safety
+	const batchSize = 5000
+	var totalAffected int64
+
+	for i := 0; i < len(missingFiles); i += batchSize {
+		end := i + batchSize
+		if end > len(missingFiles) {
+			end = len(missingFiles)
+		}
+
+		batch := missingFiles[i:end]
+
+		// Build IN clause for this batch
+		placeholders := make([]string, len(batch))
+		args := make([]interface{}, len(batch))
+		for j, file := range batch {
+			placeholders[j] = "?"
+			args[j] = file
+		}
+
+		query := fmt.Sprintf("DELETE FROM %s WHERE value%s IN (%s)",
+			tableName, collateClause(config), strings.Join(placeholders, ","))
+
+		batchStart := time.Now()
+		result, err := dbExec(db, query, args...)
+		if err != nil {
+			return totalAffected, err
+		}
+		stats.addTiming(fmt.Sprintf("remove_orphans_batch_%d", i/batchSize+1), time.Since(batchStart))
+
+		affected, _ := result.RowsAffected()
+		totalAffected += affected
+
+		fmt.Fprintf(stdout, "Processed batch %d-%d: removed %d rows\n", i+1, end, affected)
+	}
+
+	return totalAffected, nil
+}
+
+func updateDatabaseForDuplicatesBatch(db *sql.DB, config Config, mappings []DuplicateMapping) (int64, int64, error) {
+	if len(mappings) == 0 {
+		return 0, 0, nil
+	}
+
+	varcharTable := config.DBTablePrefix + "catalog_product_entity_varchar"
+	galleryTable := config.DBTablePrefix + "catalog_product_entity_media_gallery"
+
+	// Build SQL for batch updates
+	varcharSQL, varcharArgs := buildBatchUpdateSQL(varcharTable, mappings, config)
+	gallerySQL, galleryArgs := buildBatchUpdateSQL(galleryTable, mappings, config)
+
+	// Start transaction
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback() // Rollback if not committed
+
+	// Update varchar table
+	vResult, err := dbExec(tx, varcharSQL, varcharArgs...)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to update varchar table: %v", err)
+	}
+	vRows, _ := vResult.RowsAffected()
+
+	// Update gallery table
+	gResult, err := dbExec(tx, gallerySQL, galleryArgs...)
+	if err != nil {
+		return vRows, 0, fmt.Errorf("failed to update gallery table: %v", err)
+	}
+	gRows, _ := gResult.RowsAffected()
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		return vRows, gRows, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return vRows, gRows, nil
+}
+
+// collateClause returns the COLLATE clause for path comparisons with
+// --db-collation, or an empty string to use the collation of the column
+func collateClause(config Config) string {
+	if config.DBCollation == "" {
+		return ""
+	}
+	return " COLLATE " + config.DBCollation
+}
+
+func buildBatchUpdateSQL(tableName string, mappings []DuplicateMapping, config Config) (string, []interface{}) {
+	var sql strings.Builder
+	args := make([]interface{}, 0, len(mappings)*3)
+
+	// Each mapping adds "WHEN ? THEN ? " to the CASE and "?, " to the IN list
+	sql.Grow(len(tableName) + 64 + len(mappings)*17)
+	sql.WriteString("UPDATE ")
+	sql.WriteString(tableName)
+	sql.WriteString(" SET value = CASE value")
+	sql.WriteString(collateClause(config))
+
+	// CASE WHEN value = ? THEN ?
+	for _, mapping := range mappings {
+		sql.WriteString(" WHEN ? THEN ?")
+		args = append(args, mapping.Duplicate, mapping.Original)
+	}
+
+	// WHERE value IN (?, ...) - the placeholders follow all CASE pairs, so
+	// the arguments have to be appended in the same order
+	sql.WriteString(" END WHERE value")
+	sql.WriteString(collateClause(config))
+	sql.WriteString(" IN (")
+	for i, mapping := range mappings {
+		if i > 0 {
+			sql.WriteString(", ")
+		}
+		sql.WriteString("?")
+		args = append(args, mapping.Duplicate)
+	}
+	sql.WriteString(")")
+
+	if config.DBMaxPacket > 0 {
+		if size := estimatePacketSize(sql.Len(), args); size > config.DBMaxPacket*9/10 {
+			fmt.Fprintf(stdout, "Warning: The update of %s is about %d bytes, close to --db-max-packet %d\n", tableName, size, config.DBMaxPacket)
+		}
+	}
+
+	return sql.String(), args
+}
+
+// estimatePacketSize roughly estimates the bytes sent to MySQL for a
+// statement of queryLen bytes and its arguments
+func estimatePacketSize(queryLen int, args []interface{}) int64 {
+	size := int64(queryLen)
+	for _, arg := range args {
+		// Type and length prefix per argument
+		size += 9
+		if s, ok := arg.(string); ok {
+			size += int64(len(s))
+		}
+	}
+	return size
+}
+
+// writeResizeCommands writes a bin/magento catalog:product:images:resize
+// command for every 1000 products with a gallery value in missingFiles, to
+// w or below a heading to stdout if w is nil
+func writeResizeCommands(w io.Writer, db *sql.DB, config Config, missingFiles []string) error {
+	entities, err := getEntityIDsForPaths(db, config, missingFiles)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[int64]bool)
+	var ids []int64
+	for _, entityIDs := range entities {
+		for _, id := range entityIDs {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	if w == nil {
+		fmt.Fprintf(stdout, "\nResize commands for %d products with missing files:\n", len(ids))
+		w = stdout
+	}
+
+	const productsPerCommand = 1000
+	for i := 0; i < len(ids); i += productsPerCommand {
+		batch := ids[i:min(i+productsPerCommand, len(ids))]
+		parts := make([]string, len(batch))
+		for j, id := range batch {
+			parts[j] = strconv.FormatInt(id, 10)
+		}
+		fmt.Fprintf(w, "bin/magento catalog:product:images:resize --product_id=%s\n", strings.Join(parts, ","))
+	}
+	return nil
+}
+
+// getEntityIDsForPaths returns the product entity IDs linked to each of the
+// given gallery paths through catalog_product_entity_media_gallery_value_to_entity
+func getEntityIDsForPaths(db *sql.DB, config Config, paths []string) (map[string][]int64, error) {
+	galleryTable := config.DBTablePrefix + "catalog_product_entity_media_gallery"
+	linkTable := config.DBTablePrefix + "catalog_product_entity_media_gallery_value_to_entity"
+
+	entities := make(map[string][]int64, len(paths))
+
+	const batchSize = 5000
+	for i := 0; i < len(paths); i += batchSize {
+		end := i + batchSize
+		if end > len(paths) {
+			end = len(paths)
+		}
+
+		batch := paths[i:end]
+		placeholders := make([]string, len(batch))
+		args := make([]interface{}, len(batch))
+		for j, path := range batch {
+			placeholders[j] = "?"
+			args[j] = path
+		}
+
+		query := fmt.Sprintf(
+			"SELECT DISTINCT g.value, l.entity_id FROM %s g JOIN %s l ON l.value_id = g.value_id WHERE g.value%s IN (%s)",
+			galleryTable, linkTable, collateClause(config), strings.Join(placeholders, ","))
+
+		rows, err := dbQuery(db, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var value string
+			var entityID int64
+			if err := rows.Scan(&value, &entityID); err != nil {
+				continue
+			}
+			entities[value] = append(entities[value], entityID)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entities, nil
+}
+
+// printMultiProductDuplicates classifies every duplicate group as cross-product
+// (its files are assigned to different products) or same-product
+func printMultiProductDuplicates(hashMap map[dedupeKey][]FileInfo, entities map[string][]int64) {
+	fmt.Fprintln(stdout, "\nCross-product duplicates:")
+
+	var crossProduct, sameProduct int
+	for key, files := range hashMap {
+		if len(files) < 2 {
+			continue
+		}
+
+		groupEntities := make(map[int64]bool)
+		for _, file := range files {
+			for _, entityID := range entities[file.RelativePath] {
+				groupEntities[entityID] = true
+			}
+		}
+		if len(groupEntities) < 2 {
+			sameProduct++
+			continue
+		}
+
+		crossProduct++
+		fmt.Fprintf(stdout, "%s (%d products):\n", key, len(groupEntities))
+		for _, file := range files {
+			ids := make([]string, len(entities[file.RelativePath]))
+			for i, entityID := range entities[file.RelativePath] {
+				ids[i] = strconv.FormatInt(entityID, 10)
+			}
+			if len(ids) == 0 {
+				ids = append(ids, "none")
+			}
+			fmt.Fprintf(stdout, "  - %s (entity_id: %s)\n", file.RelativePath, strings.Join(ids, ", "))
+		}
+	}
+
+	fmt.Fprintf(stdout, "Cross-product duplicate groups: %d\n", crossProduct)
+	fmt.Fprintf(stdout, "Same-product duplicate groups: %d\n", sameProduct)
+}
+
+// magentoCopySuffix matches the _1, _2, ... Magento appends to the name of
+// an uploaded file that already exists
+var magentoCopySuffix = regexp.MustCompile(`_[0-9]+$`)
+
+// printDedupSavings estimates the duplicates from the gallery values alone:
+// Magento stores a re-uploaded image as name_1.jpg next to name.jpg, so
+// values that only differ in that suffix are probably copies. A sample of
+// up to 100 of these files is read from disk for the average size.
+func printDedupSavings(db *sql.DB, config Config) error {
+	galleryTable := config.DBTablePrefix + "catalog_product_entity_media_gallery"
+
+	rows, err := dbQuery(db, fmt.Sprintf(
+		"SELECT value, COUNT(*) FROM %s WHERE value IS NOT NULL AND value != '' GROUP BY value", galleryTable))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	groups := make(map[string][]string)
+	var sharedValues int64
+	for rows.Next() {
+		var value string
+		var count int64
+		if err := rows.Scan(&value, &count); err != nil {
+			continue
+		}
+		if count > 1 {
+			sharedValues++
+		}
+		ext := path.Ext(value)
+		key := path.Dir(value) + "/" + magentoCopySuffix.ReplaceAllString(strings.TrimSuffix(path.Base(value), ext), "") + ext
+		groups[key] = append(groups[key], value)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var copies []string
+	var groupCount int64
+	for _, values := range groups {
+		if len(values) > 1 {
+			sort.Strings(values)
+			copies = append(copies, values[1:]...)
+			groupCount++
+		}
+	}
+	sort.Strings(copies)
+
+	fmt.Fprintln(stdout, "\nEstimated duplicates from the gallery values (no scan):")
+	fmt.Fprintf(stdout, "Gallery values shared by several rows: %s (one file each, nothing to remove)\n", formatCount(sharedValues))
+	fmt.Fprintf(stdout, "Probable copies (name_1.jpg next to name.jpg): %s in %s groups\n", formatCount(int64(len(copies))), formatCount(groupCount))
+	if len(copies) == 0 {
+		return nil
+	}
+
+	// Every n-th copy, so the sample is spread over the whole catalog
+	const sampleSize = 100
+	step := len(copies)/sampleSize + 1
+	var sampled, sampledBytes int64
+	for i := 0; i < len(copies); i += step {
+		if info, err := os.Stat(config.MediaPath + copies[i]); err == nil {
+			sampled++
+			sampledBytes += info.Size()
+		}
+	}
+	if sampled > 0 {
+		average := sampledBytes / sampled
+		fmt.Fprintf(stdout, "Estimated savings: %.1f MB (average size %.1f KB from %d sampled files)\n",
+			float64(average*int64(len(copies)))/1024/1024, float64(average)/1024, sampled)
+	}
+	fmt.Fprintln(stdout, "Copies with different content are not duplicates, run --remove-duplicates to find and fix the real ones")
+
+	return nil
+}
+
+// printDuplicateHistogram prints the number of duplicate groups per group
+// size and the space taken by all but one file of those groups
+func printDuplicateHistogram(hashMap map[dedupeKey][]FileInfo) {
+	groups := make(map[int]int64)
+	wasted := make(map[int]int64)
+	for _, files := range hashMap {
+		if len(files) < 2 {
+			continue
+		}
+		groups[len(files)]++
+		for _, file := range files[1:] {
+			wasted[len(files)] += file.Size
+		}
+	}
+
+	sizes := make([]int, 0, len(groups))
+	for size := range groups {
+		sizes = append(sizes, size)
+	}
+	sort.Ints(sizes)
+
+	fmt.Fprintln(stdout, "\nDuplicate group sizes:")
+	for _, size := range sizes {
+		fmt.Fprintf(stdout, "%d files: %s groups (%.1f GB wasted)\n", size, formatCount(groups[size]), float64(wasted[size])/(1<<30))
+	}
+	if len(sizes) == 0 {
+		fmt.Fprintln(stdout, "No duplicates found")
+	}
+}
+
+// printMimeDistribution sniffs the content type of every file in filesMap
+// from its first 512 bytes with http.DetectContentType and prints the number
+// and size of the files per content type and extension, most files first
+func printMimeDistribution(config Config, filesMap map[string]FileInfo) {
+	type mimeKey struct {
+		mime, ext string
+	}
+	type mimeCount struct {
+		files, bytes int64
+	}
+
+	pathChan := make(chan FileInfo, 1000)
+	go func() {
+		for _, fileInfo := range filesMap {
+			pathChan <- fileInfo
+		}
+		close(pathChan)
+	}()
+
+	var mu sync.Mutex
+	counts := make(map[mimeKey]*mimeCount)
+	var wg sync.WaitGroup
+	for i := 0; i < config.WorkerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 512)
+			for fileInfo := range pathChan {
+				f, err := os.Open(config.MediaPath + fileInfo.RelativePath)
+				if err != nil {
+					continue
+				}
+				n, _ := io.ReadFull(f, buf)
+				f.Close()
+
+				mime, _, _ := strings.Cut(http.DetectContentType(buf[:n]), ";")
+				key := mimeKey{mime: mime, ext: strings.ToLower(filepath.Ext(fileInfo.RelativePath))}
+				mu.Lock()
+				c := counts[key]
+				if c == nil {
+					c = &mimeCount{}
+					counts[key] = c
+				}
+				c.files++
+				c.bytes += fileInfo.Size
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	keys := make([]mimeKey, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]].files != counts[keys[j]].files {
+			return counts[keys[i]].files > counts[keys[j]].files
+		}
+		if keys[i].mime != keys[j].mime {
+			return keys[i].mime < keys[j].mime
+		}
+		return keys[i].ext < keys[j].ext
+	})
+
+	fmt.Fprintln(stdout, "\nFiles per content type:")
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DETECTED MIME\tEXTENSION\tFILES\tSIZE")
+	for _, key := range keys {
+		c := counts[key]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.1f MB\n", key.mime, key.ext, formatCount(c.files), float64(c.bytes)/1024/1024)
+	}
+	tw.Flush()
+}
+
+// findPathEncodingIssues returns the paths of filesMap that change when
+// normalized to NFC, sorted
+func findPathEncodingIssues(filesMap map[string]FileInfo) []string {
+	var paths []string
+	for path := range filesMap {
+		if !norm.NFC.IsNormalString(path) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// printPathEncodingIssues prints the number of paths that are not NFC
+// normalized and the first of them. Names are quoted, the precomposed and
+// decomposed forms look the same otherwise.
+func printPathEncodingIssues(paths []string, dbPathsMap map[string]bool) {
+	const examples = 10
+
+	fmt.Fprintln(stdout, "\nPaths that are not NFC normalized:")
+	var referenced int
+	for i, path := range paths {
+		normalized := norm.NFC.String(path)
+		if dbPathsMap[normalized] {
+			referenced++
+		}
+		if i >= examples {
+			continue
+		}
+
+		note := ""
+		if dbPathsMap[normalized] {
+			note = " (referenced in the database)"
+		}
+		fmt.Fprintf(stdout, "%s -> %s%s\n", strconv.QuoteToASCII(path), strconv.QuoteToASCII(normalized), note)
+	}
+	if len(paths) > examples {
+		fmt.Fprintf(stdout, "... and %d more\n", len(paths)-examples)
+	}
+	fmt.Fprintf(stdout, "Found %d paths that are not NFC normalized, %d referenced in the database by their NFC form\n", len(paths), referenced)
+}
+
+// splitImageSuffix matches the size suffix import tools add to the name of
+// a smaller or larger copy of an image, e.g. product_small or product-800x600
+var splitImageSuffix = regexp.MustCompile(`(?i)[_-](small|thumb|thumbnail|medium|large|big|hires|lowres|zoom|[0-9]+x[0-9]+)$`)
+
+// findSplitImages groups the gallery images of filesMap by directory and
+// name without a size suffix. Groups with at least two files, one of them
+// with a suffix, are returned sorted by path, each largest file first.
+func findSplitImages(filesMap map[string]FileInfo, dbPaths []string) [][]FileInfo {
+	byBase := make(map[string][]FileInfo)
+	hasSuffix := make(map[string]bool)
+	seen := make(map[string]bool, len(dbPaths))
+	for _, value := range dbPaths {
+		info, ok := filesMap[value]
+		if !ok || seen[value] {
+			continue
+		}
+		seen[value] = true
+
+		name := strings.TrimSuffix(path.Base(value), path.Ext(value))
+		base := splitImageSuffix.ReplaceAllString(name, "")
+		key := path.Dir(value) + "/" + base
+		if base != name {
+			hasSuffix[key] = true
+		}
+		byBase[key] = append(byBase[key], info)
+	}
+
+	var groups [][]FileInfo
+	for key, files := range byBase {
+		if len(files) < 2 || !hasSuffix[key] {
+			continue
+		}
+		sort.Slice(files, func(i, j int) bool {
+			if files[i].Size != files[j].Size {
+				return files[i].Size > files[j].Size
+			}
+			return files[i].RelativePath < files[j].RelativePath
+		})
+		groups = append(groups, files)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i][0].RelativePath < groups[j][0].RelativePath
+	})
+	return groups
+}
+
+// printSplitImages prints every group of size variants with the size of
+// each file and its size quartile among all scanned files (Q1 smallest),
+// and notes the variants with the same content as another one
+func printSplitImages(groups [][]FileInfo, filesMap map[string]FileInfo) {
+	sizes := make([]int64, 0, len(filesMap))
+	for _, info := range filesMap {
+		sizes = append(sizes, info.Size)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	quartile := func(size int64) int {
+		// Number of files smaller than size, as a quarter of all files
+		below := sort.Search(len(sizes), func(i int) bool { return sizes[i] >= size })
+		return min(below*4/len(sizes), 3) + 1
+	}
+
+	fmt.Fprintln(stdout, "\nImages stored in several size variants (not deduplicated):")
+	var sameContent int
+	for _, files := range groups {
+		fmt.Fprintf(stdout, "%s:\n", files[0].RelativePath)
+		for i, file := range files {
+			note := ""
+			for _, larger := range files[:i] {
+				if file.Hash != 0 && file.Hash == larger.Hash && file.Size == larger.Size {
+					note = " (same content as " + larger.RelativePath + ")"
+					sameContent++
+					break
+				}
+			}
+			fmt.Fprintf(stdout, "  - %s  %s bytes  Q%d%s\n", file.RelativePath, formatCount(file.Size), quartile(file.Size), note)
+		}
+	}
+	fmt.Fprintf(stdout, "Found %d images in several size variants, %d with the same content in two variants\n", len(groups), sameContent)
+}
+
+// fixPathEncodings renames the files at paths to their NFC form and points
+// the gallery and attribute values to the new path, in batches of 5000. A
+// batch whose database update fails is renamed back. Returns the new path of
+// every renamed file and whether a failed rename stopped all further cleanup.
+func fixPathEncodings(db *sql.DB, config Config, stats *Stats, paths []string) (map[string]string, bool) {
+	renamed := make(map[string]string, len(paths))
+	if len(paths) == 0 {
+		return renamed, false
+	}
 
-			// Update database
-			vUpdated, gUpdated, err := updateDatabaseForDuplicatesBatch(db, config, batch)
-			if err != nil {
-				fmt.Printf("Error updating batch %d: %v\n", batchNum, err)
-				continue // Skip file deletion for failed batch
+	fmt.Fprintf(stdout, "\nNormalizing %d paths to NFC...\n", len(paths))
+	var mappings []DuplicateMapping
+	stopped := false
+	for _, path := range paths {
+		normalized := norm.NFC.String(path)
+		if _, err := os.Lstat(config.MediaPath + normalized); err == nil {
+			fmt.Fprintf(stdout, "Warning: Skipping %s, %s already exists\n", strconv.QuoteToASCII(path), strconv.QuoteToASCII(normalized))
+			continue
+		}
+		if err := os.Rename(config.MediaPath+path, config.MediaPath+normalized); err != nil {
+			if fileOperationFailed(config, stats, err) {
+				stopped = true
+				break
 			}
+			continue
+		}
+		mappings = append(mappings, DuplicateMapping{Original: normalized, Duplicate: path})
+	}
 
-			// Delete files only after successful database update
+	const batchSize = 5000
+	for i := 0; i < len(mappings); i += batchSize {
+		end := i + batchSize
+		if end > len(mappings) {
+			end = len(mappings)
+		}
+		batch := mappings[i:end]
+
+		vUpdated, gUpdated, err := updateDatabaseForDuplicatesBatch(db, config, batch)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error updating the database, renaming %d files back: %v\n", len(batch), err)
 			for _, mapping := range batch {
-				if err := os.Remove(mapping.FullPath); err == nil {
-					atomic.AddInt64(&stats.RemovedDuplicates, 1)
-					atomic.AddInt64(&stats.BytesFreed, mapping.Size)
+				if err := os.Rename(config.MediaPath+mapping.Original, config.MediaPath+mapping.Duplicate); err != nil {
+					fmt.Fprintf(stdout, "Error: %v\n", err)
 				}
 			}
+			if operationFailed(config) {
+				return renamed, true
+			}
+			continue
+		}
 
-			atomic.AddInt64(&stats.UpdatedVarchar, vUpdated)
-			atomic.AddInt64(&stats.UpdatedGallery, gUpdated)
+		for _, mapping := range batch {
+			renamed[mapping.Duplicate] = mapping.Original
+			fmt.Fprintf(stdout, "Renamed: %s -> %s\n", strconv.QuoteToASCII(mapping.Duplicate), strconv.QuoteToASCII(mapping.Original))
 		}
+		atomic.AddInt64(&stats.FixedPathEncoding, int64(len(batch)))
+		atomic.AddInt64(&stats.UpdatedVarchar, vUpdated)
+		atomic.AddInt64(&stats.UpdatedGallery, gUpdated)
+	}
+	return renamed, stopped
+}
 
-		duplicateDuration := time.Since(duplicateStart)
-		fmt.Printf("\nDuplicate removal completed in %v\n", duplicateDuration.Round(time.Millisecond))
+// renameScannedFiles moves the scanned files in renamed (old path to new
+// path) to their new path in filesMap and hashMap
+func renameScannedFiles(filesMap map[string]FileInfo, hashMap map[dedupeKey][]FileInfo, renamed map[string]string) {
+	if len(renamed) == 0 {
+		return
+	}
+	for from, to := range renamed {
+		info := filesMap[from]
+		info.RelativePath = to
+		delete(filesMap, from)
+		filesMap[to] = info
 	}
+	for _, files := range hashMap {
+		for i := range files {
+			if to, ok := renamed[files[i].RelativePath]; ok {
+				files[i].RelativePath = to
+			}
+		}
+	}
+}
 
-	// Print summary
-	totalDuration := time.Since(startTime)
-	printStats(stats, len(dbPaths), scanDuration, dbDuration, totalDuration)
+// printGalleryStats prints read-only statistics about the shape of the media
+// gallery tables
+func printGalleryStats(db *sql.DB, config Config, threshold int) error {
+	galleryTable := config.DBTablePrefix + "catalog_product_entity_media_gallery"
+	valueTable := config.DBTablePrefix + "catalog_product_entity_media_gallery_value"
+	linkTable := config.DBTablePrefix + "catalog_product_entity_media_gallery_value_to_entity"
+
+	var entries int64
+	if err := dbQueryRow(db, fmt.Sprintf("SELECT COUNT(*) FROM %s", galleryTable)).Scan(&entries); err != nil {
+		return err
+	}
+
+	var links, products int64
+	if err := dbQueryRow(db, fmt.Sprintf("SELECT COUNT(*), COUNT(DISTINCT entity_id) FROM %s", linkTable)).Scan(&links, &products); err != nil {
+		return err
+	}
+
+	var large, single int64
+	if err := dbQueryRow(db, fmt.Sprintf(
+		"SELECT COALESCE(SUM(images > ?), 0), COALESCE(SUM(images = 1), 0) FROM "+
+			"(SELECT COUNT(*) AS images FROM %s GROUP BY entity_id) t", linkTable),
+		threshold).Scan(&large, &single); err != nil {
+		return err
+	}
+
+	var values, disabled int64
+	if err := dbQueryRow(db, fmt.Sprintf("SELECT COUNT(*), COALESCE(SUM(disabled = 1), 0) FROM %s", valueTable)).Scan(&values, &disabled); err != nil {
+		return err
+	}
+
+	rows, err := dbQuery(db, fmt.Sprintf("SELECT store_id, COUNT(*) FROM %s GROUP BY store_id ORDER BY store_id", valueTable))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type storeCount struct {
+		storeID int64
+		count   int64
+	}
+	var perStore []storeCount
+	for rows.Next() {
+		var sc storeCount
+		if err := rows.Scan(&sc.storeID, &sc.count); err != nil {
+			continue
+		}
+		perStore = append(perStore, sc)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(stdout, "\nMedia gallery statistics:")
+	fmt.Fprintf(stdout, "Gallery entries: %d\n", entries)
+	fmt.Fprintf(stdout, "Products with images: %d\n", products)
+	if products > 0 {
+		fmt.Fprintf(stdout, "Average images per product: %.2f\n", float64(links)/float64(products))
+	}
+	fmt.Fprintf(stdout, "Products with more than %d images: %d\n", threshold, large)
+	fmt.Fprintf(stdout, "Products with a single image: %d\n", single)
+	if values > 0 {
+		fmt.Fprintf(stdout, "Disabled images: %d of %d (%.1f%%)\n", disabled, values, float64(disabled)*100/float64(values))
+	}
+	fmt.Fprintln(stdout, "Entries per store view:")
+	for _, sc := range perStore {
+		fmt.Fprintf(stdout, "  store_id %d: %d\n", sc.storeID, sc.count)
+	}
+
+	return nil
 }
 
-func connectDB(config Config) (*sql.DB, error) {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
-		config.DBUser, config.DBPass, config.DBHost, config.DBPort, config.DBName)
+// printStoreSpecificImages lists the gallery values that have a value row for
+// a store view but none for the admin scope, with the state of that store
+// view, and returns their number. The store table is read from storeDB, it
+// is not a catalog table in split database setups.
+func printStoreSpecificImages(catalogDB, storeDB *sql.DB, config Config) (int64, error) {
+	galleryTable := config.DBTablePrefix + "catalog_product_entity_media_gallery"
+	valueTable := config.DBTablePrefix + "catalog_product_entity_media_gallery_value"
+	storeTable := config.DBTablePrefix + "store"
 
-	db, err := sql.Open("mysql", dsn)
+	active := make(map[int64]bool)
+	rows, err := dbQuery(storeDB, fmt.Sprintf("SELECT store_id, is_active FROM %s", storeTable))
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	for rows.Next() {
+		var storeID int64
+		var isActive bool
+		if err := rows.Scan(&storeID, &isActive); err == nil {
+			active[storeID] = isActive
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
 	}
 
-	if err := db.Ping(); err != nil {
-		return nil, err
+	rows, err = dbQuery(catalogDB, fmt.Sprintf(
+		"SELECT DISTINCT v.store_id, g.value FROM %s v JOIN %s g ON g.value_id = v.value_id "+
+			"WHERE v.store_id != 0 AND NOT EXISTS (SELECT 1 FROM %s a WHERE a.value_id = v.value_id AND a.store_id = 0) "+
+			"ORDER BY v.store_id, g.value",
+		valueTable, galleryTable, valueTable))
+	if err != nil {
+		return 0, err
 	}
+	defer rows.Close()
 
-	return db, nil
+	fmt.Fprintln(stdout, "\nImages only assigned in a store view:")
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STORE_ID\tSTORE\tPATH")
+	paths := make(map[string]bool)
+	for rows.Next() {
+		var storeID int64
+		var value sql.NullString
+		if err := rows.Scan(&storeID, &value); err != nil || !value.Valid {
+			continue
+		}
+
+		state := "removed"
+		if isActive, ok := active[storeID]; ok && isActive {
+			state = "active"
+		} else if ok {
+			state = "inactive"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", storeID, state, value.String)
+		paths[value.String] = true
+	}
+	tw.Flush()
+	if err := rows.Err(); err != nil {
+		return int64(len(paths)), err
+	}
+	fmt.Fprintf(stdout, "Found %d images only assigned in a store view\n", len(paths))
+
+	return int64(len(paths)), nil
 }
 
-func scanFilesystem(config Config, stats *Stats) (map[string]FileInfo, map[uint64][]FileInfo) {
-	// Channel for file paths
-	fileChan := make(chan string, 10000)
+// printVideoEntries counts the video gallery entries whose URL points to an
+// external service (http or https, e.g. YouTube or Vimeo), those with a
+// local video URL and the broken ones without a URL, and how many of
+// missingFiles are the preview images of a video. Returns the number of
+// external and local entries.
+func printVideoEntries(db *sql.DB, config Config, missingFiles []string) (int64, int64, error) {
+	galleryTable := config.DBTablePrefix + "catalog_product_entity_media_gallery"
+	videoTable := config.DBTablePrefix + "catalog_product_entity_media_gallery_value_video"
 
-	// Start recursive directory walker in a single goroutine
-	var walkerWg sync.WaitGroup
-	walkerWg.Add(1)
-	go func() {
-		defer walkerWg.Done()
-		walkDirectoryRecursive(config.MediaPath, fileChan)
-		close(fileChan)
-	}()
+	missing := make(map[string]bool, len(missingFiles))
+	for _, path := range missingFiles {
+		missing[path] = true
+	}
 
-	// Worker-local maps for each worker
-	type workerResult struct {
-		filesMap map[string]FileInfo
-		hashMap  map[uint64][]FileInfo
+	rows, err := dbQuery(db, fmt.Sprintf(
+		"SELECT v.value_id, v.url, g.value FROM %s v JOIN %s g ON g.value_id = v.value_id",
+		videoTable, galleryTable))
+	if err != nil {
+		return 0, 0, err
 	}
+	defer rows.Close()
 
-	resultChan := make(chan workerResult, config.WorkerCount)
-	var wg sync.WaitGroup
+	// A video has a row per store view, the admin row is not guaranteed
+	seen := make(map[int64]bool)
+	var external, local, withoutURL, missingPreviews int64
+	for rows.Next() {
+		var valueID int64
+		var url, value sql.NullString
+		if err := rows.Scan(&valueID, &url, &value); err != nil || seen[valueID] {
+			continue
+		}
+		seen[valueID] = true
 
-	// Start file processing workers with local maps
-	for i := 0; i < config.WorkerCount; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			localFiles := make(map[string]FileInfo, 50000)
-			localHashes := make(map[uint64][]FileInfo, 10000)
+		lower := strings.ToLower(strings.TrimSpace(url.String))
+		if lower == "" {
+			withoutURL++
+		} else if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "//") {
+			external++
+		} else {
+			local++
+		}
+		if value.Valid && missing[value.String] {
+			missingPreviews++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return external, local, err
+	}
 
-			for path := range fileChan {
-				processFileLocal(path, config.MediaPath, stats, localFiles, localHashes)
-			}
+	fmt.Fprintln(stdout, "\nVideo gallery entries:")
+	fmt.Fprintf(stdout, "External videos (YouTube, Vimeo, ...): %s\n", formatCount(external))
+	fmt.Fprintf(stdout, "Local videos: %s\n", formatCount(local))
+	if withoutURL > 0 {
+		fmt.Fprintf(stdout, "Broken entries without a video URL: %s\n", formatCount(withoutURL))
+	}
+	fmt.Fprintf(stdout, "Missing preview images: %s of %s missing files\n", formatCount(missingPreviews), formatCount(int64(len(missingFiles))))
+
+	return external, local, nil
+}
+
+// printAttributeSetBreakdown prints the gallery images per attribute set of
+// the products they are linked to, and how many of them are missing or
+// unused. Files are only unused despite a gallery row with
+// --require-gallery-entry or --include-only-products, all other unused files
+// have no product and are counted separately.
+func printAttributeSetBreakdown(db *sql.DB, config Config, unusedFiles, missingFiles []string) error {
+	productTable := config.DBTablePrefix + "catalog_product_entity"
+	galleryTable := config.DBTablePrefix + "catalog_product_entity_media_gallery"
+	linkTable := config.DBTablePrefix + "catalog_product_entity_media_gallery_value_to_entity"
+	setTable := config.DBTablePrefix + "eav_attribute_set"
+
+	rows, err := dbQuery(db, fmt.Sprintf(
+		"SELECT DISTINCT COALESCE(s.attribute_set_name, CONCAT('#', e.attribute_set_id)), g.value FROM %s l "+
+			"JOIN %s g ON g.value_id = l.value_id JOIN %s e ON e.entity_id = l.entity_id "+
+			"LEFT JOIN %s s ON s.attribute_set_id = e.attribute_set_id WHERE g.value IS NOT NULL",
+		linkTable, galleryTable, productTable, setTable))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	missing := make(map[string]bool, len(missingFiles))
+	for _, path := range missingFiles {
+		missing[path] = true
+	}
+	unused := make(map[string]bool, len(unusedFiles))
+	for _, path := range unusedFiles {
+		unused[path] = true
+	}
+
+	type setCounts struct {
+		images, missing, unused int64
+	}
+	counts := make(map[string]*setCounts)
+	attributed := make(map[string]bool)
+	for rows.Next() {
+		var set, value string
+		if err := rows.Scan(&set, &value); err != nil {
+			continue
+		}
+		c := counts[set]
+		if c == nil {
+			c = &setCounts{}
+			counts[set] = c
+		}
+		c.images++
+		if missing[value] {
+			c.missing++
+		}
+		if unused[value] {
+			c.unused++
+			attributed[value] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	sets := make([]string, 0, len(counts))
+	for set := range counts {
+		sets = append(sets, set)
+	}
+	sort.Slice(sets, func(i, j int) bool {
+		if counts[sets[i]].images != counts[sets[j]].images {
+			return counts[sets[i]].images > counts[sets[j]].images
+		}
+		return sets[i] < sets[j]
+	})
+
+	fmt.Fprintln(stdout, "\nImages per attribute set:")
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ATTRIBUTE SET\tIMAGES\tMISSING\tMISSING %\tUNUSED")
+	for _, set := range sets {
+		c := counts[set]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.1f%%\t%s\n", set, formatCount(c.images), formatCount(c.missing),
+			float64(c.missing)*100/float64(c.images), formatCount(c.unused))
+	}
+	tw.Flush()
+	fmt.Fprintf(stdout, "Unused files without a product: %s\n", formatCount(int64(len(unusedFiles)-len(attributed))))
+
+	return nil
+}
+
+// imageCountBuckets are the ranges of --report-product-image-count-stats, a
+// product falls into the first bucket whose max is not below its image count
+var imageCountBuckets = []struct {
+	label string
+	max   int64
+}{
+	{"0", 0},
+	{"1", 1},
+	{"2-5", 5},
+	{"6-10", 10},
+	{"11-20", 20},
+	{">20", math.MaxInt64},
+}
+
+// printImageCountStats prints the number of products per image count bucket,
+// in total and per product type. Products without gallery links count as 0.
+func printImageCountStats(db *sql.DB, config Config) error {
+	productTable := config.DBTablePrefix + "catalog_product_entity"
+	linkTable := config.DBTablePrefix + "catalog_product_entity_media_gallery_value_to_entity"
+
+	rows, err := dbQuery(db, fmt.Sprintf(
+		"SELECT type_id, images, COUNT(*) FROM "+
+			"(SELECT e.type_id, COUNT(l.value_id) AS images FROM %s e LEFT JOIN %s l ON l.entity_id = e.entity_id "+
+			"GROUP BY e.entity_id, e.type_id) t GROUP BY type_id, images",
+		productTable, linkTable))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 
-			resultChan <- workerResult{
-				filesMap: localFiles,
-				hashMap:  localHashes,
+	counts := make(map[string][]int64)
+	total := make([]int64, len(imageCountBuckets))
+	var products int64
+	for rows.Next() {
+		var typeID string
+		var images, count int64
+		if err := rows.Scan(&typeID, &images, &count); err != nil {
+			continue
+		}
+		if counts[typeID] == nil {
+			counts[typeID] = make([]int64, len(imageCountBuckets))
+		}
+		for i, bucket := range imageCountBuckets {
+			if images <= bucket.max {
+				counts[typeID][i] += count
+				total[i] += count
+				break
 			}
-		}()
+		}
+		products += count
+	}
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
-	// Wait for all workers to finish
-	go func() {
-		wg.Wait()
-		close(resultChan)
-	}()
+	types := make([]string, 0, len(counts))
+	for typeID := range counts {
+		types = append(types, typeID)
+	}
+	sort.Strings(types)
 
-	// Wait for walker to finish
-	walkerWg.Wait()
+	fmt.Fprintln(stdout, "\nProducts per image count:")
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "IMAGES\tPRODUCTS\tSHARE")
+	for _, typeID := range types {
+		fmt.Fprintf(tw, "\t%s", strings.ToUpper(typeID))
+	}
+	fmt.Fprintln(tw)
+	for i, bucket := range imageCountBuckets {
+		share := 0.0
+		if products > 0 {
+			share = float64(total[i]) * 100 / float64(products)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.1f%%", bucket.label, formatCount(total[i]), share)
+		for _, typeID := range types {
+			fmt.Fprintf(tw, "\t%s", formatCount(counts[typeID][i]))
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+	fmt.Fprintf(stdout, "Products: %s\n", formatCount(products))
+
+	return nil
+}
+
+// getWatermarkPaths returns the watermark images configured in
+// core_config_data, relative to the media path. Magento stores them below
+// catalog/product/watermark.
+func getWatermarkPaths(db *sql.DB, config Config) ([]string, error) {
+	configTable := config.DBTablePrefix + "core_config_data"
 
-	// Merge all worker results
-	finalFilesMap := make(map[string]FileInfo, 500000)
-	finalHashMap := make(map[uint64][]FileInfo, 100000)
+	rows, err := dbQuery(db, fmt.Sprintf(
+		"SELECT DISTINCT value FROM %s WHERE (path LIKE 'design/watermark/%%\\_image' OR path LIKE 'catalog/watermark/%%image') "+
+			"AND value IS NOT NULL AND value != ''",
+		configTable))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	for result := range resultChan {
-		// Merge files
-		for path, fileInfo := range result.filesMap {
-			finalFilesMap[path] = fileInfo
+	var paths []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			continue
 		}
+		paths = append(paths, "/watermark/"+strings.TrimPrefix(value, "/"))
+	}
+
+	return paths, rows.Err()
+}
 
-		// Merge hashes
-		for hash, files := range result.hashMap {
-			finalHashMap[hash] = append(finalHashMap[hash], files...)
+// getSwatchImagePaths returns the image paths of all visual swatches, relative
+// to pub/media/attribute/swatch
+func getSwatchImagePaths(db *sql.DB, config Config) (map[string]bool, error) {
+	swatchTable := config.DBTablePrefix + "eav_attribute_option_swatch"
+
+	// type 2 is a visual swatch with an image, 1 a color code and 0 text
+	rows, err := dbQuery(db, fmt.Sprintf("SELECT swatch_value FROM %s WHERE type = 2 AND swatch_value IS NOT NULL", swatchTable))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	paths := make(map[string]bool)
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			continue
 		}
+		paths[value] = true
 	}
 
-	// Count duplicates correctly (once per group, not per file)
-	for _, files := range finalHashMap {
-		if len(files) > 1 {
-			atomic.AddInt64(&stats.DuplicateFiles, int64(len(files)-1))
+	return paths, rows.Err()
+}
+
+// getCustomerImagePaths returns the values of all file and image attributes of
+// customers and customer addresses, relative to pub/media/customer
+func getCustomerImagePaths(db *sql.DB, config Config) (map[string]bool, error) {
+	customerTable := config.DBTablePrefix + "customer_entity_varchar"
+	addressTable := config.DBTablePrefix + "customer_address_entity_varchar"
+	attributeTable := config.DBTablePrefix + "eav_attribute"
+
+	query := fmt.Sprintf(
+		"SELECT v.value FROM %s v JOIN %s a ON a.attribute_id = v.attribute_id "+
+			"WHERE a.frontend_input IN ('file', 'image') AND v.value IS NOT NULL "+
+			"UNION SELECT v.value FROM %s v JOIN %s a ON a.attribute_id = v.attribute_id "+
+			"WHERE a.frontend_input IN ('file', 'image') AND v.value IS NOT NULL",
+		customerTable, attributeTable, addressTable, attributeTable)
+
+	rows, err := dbQuery(db, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	paths := make(map[string]bool)
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			continue
 		}
+		paths[value] = true
 	}
 
-	return finalFilesMap, finalHashMap
+	return paths, rows.Err()
 }
 
-// walkDirectoryRecursive recursively walks directories and sends files to fileChan
-func walkDirectoryRecursive(dir string, fileChan chan<- string) {
-	entries, err := os.ReadDir(dir)
+// getProductImageSets returns the set of gallery paths per product entity ID
+// and the SKU of each of these products
+func getProductImageSets(db *sql.DB, config Config) (map[int64]map[string]bool, map[int64]string, error) {
+	productTable := config.DBTablePrefix + "catalog_product_entity"
+	galleryTable := config.DBTablePrefix + "catalog_product_entity_media_gallery"
+	linkTable := config.DBTablePrefix + "catalog_product_entity_media_gallery_value_to_entity"
+
+	query := fmt.Sprintf(
+		"SELECT e.entity_id, e.sku, g.value FROM %s e JOIN %s l ON l.entity_id = e.entity_id "+
+			"JOIN %s g ON g.value_id = l.value_id",
+		productTable, linkTable, galleryTable)
+
+	var args []interface{}
+	if config.OnlyPathPrefix != "" {
+		query += " WHERE g.value LIKE ?"
+		args = append(args, escapeLike(config.OnlyPathPrefix)+"%")
+	}
+
+	rows, err := dbQuery(db, query, args...)
 	if err != nil {
-		return
+		return nil, nil, err
 	}
+	defer rows.Close()
 
-	// Image extensions to filter
-	imageExts := map[string]bool{
-		".jpg":  true,
-		".jpeg": true,
-		".png":  true,
-		".gif":  true,
-		".webp": true,
-		".avif": true,
+	productImageSet := make(map[int64]map[string]bool)
+	skus := make(map[int64]string)
+	for rows.Next() {
+		var entityID int64
+		var sku, value sql.NullString
+		if err := rows.Scan(&entityID, &sku, &value); err != nil || !value.Valid {
+			continue
+		}
+		if productImageSet[entityID] == nil {
+			productImageSet[entityID] = make(map[string]bool)
+		}
+		productImageSet[entityID][value.String] = true
+		skus[entityID] = sku.String
 	}
 
-	for _, entry := range entries {
-		fullPath := filepath.Join(dir, entry.Name())
+	return productImageSet, skus, rows.Err()
+}
 
-		if entry.IsDir() {
-			// Recursively process subdirectory
-			walkDirectoryRecursive(fullPath, fileChan)
-		} else {
-			// Only process image files
-			ext := strings.ToLower(filepath.Ext(entry.Name()))
-			if imageExts[ext] {
-				fileChan <- fullPath
+// printDuplicateProducts reports groups of products with identical image
+// sets. Duplicate files count as the same image, so products using different
+// copies of the same images are grouped as well.
+func printDuplicateProducts(productImageSet map[int64]map[string]bool, skus map[int64]string, hashMap map[dedupeKey][]FileInfo) {
+	canonical := make(map[string]string)
+	for _, files := range hashMap {
+		if len(files) > 1 {
+			for _, file := range files {
+				canonical[file.RelativePath] = files[0].RelativePath
+			}
+		}
+	}
+
+	groups := make(map[string][]int64)
+	for entityID, images := range productImageSet {
+		paths := make([]string, 0, len(images))
+		seen := make(map[string]bool, len(images))
+		for path := range images {
+			if original, ok := canonical[path]; ok {
+				path = original
+			}
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+		sort.Strings(paths)
+		key := strings.Join(paths, "\x00")
+		groups[key] = append(groups[key], entityID)
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key, entityIDs := range groups {
+		if len(entityIDs) > 1 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintln(stdout, "\nPotentially duplicate products:")
+	for _, key := range keys {
+		entityIDs := groups[key]
+		sort.Slice(entityIDs, func(i, j int) bool { return entityIDs[i] < entityIDs[j] })
+
+		products := make([]string, len(entityIDs))
+		for i, entityID := range entityIDs {
+			products[i] = fmt.Sprintf("%s (entity_id: %d)", skus[entityID], entityID)
+		}
+		fmt.Fprintf(stdout, "%d images: %s\n", strings.Count(key, "\x00")+1, strings.Join(products, ", "))
+	}
+	fmt.Fprintf(stdout, "Groups of products with identical images: %d\n", len(keys))
+}
+
+// collectSKUsForPaths adds the SKUs of all products referencing any of the
+// given paths, either through the media gallery or an image attribute
+func collectSKUsForPaths(db *sql.DB, config Config, paths []string, skus map[string]bool) error {
+	productTable := config.DBTablePrefix + "catalog_product_entity"
+	varcharTable := config.DBTablePrefix + "catalog_product_entity_varchar"
+	galleryTable := config.DBTablePrefix + "catalog_product_entity_media_gallery"
+	linkTable := config.DBTablePrefix + "catalog_product_entity_media_gallery_value_to_entity"
+
+	const batchSize = 5000
+	for i := 0; i < len(paths); i += batchSize {
+		end := i + batchSize
+		if end > len(paths) {
+			end = len(paths)
+		}
+
+		batch := paths[i:end]
+		placeholders := make([]string, len(batch))
+		args := make([]interface{}, 0, len(batch)*2)
+		for j, path := range batch {
+			placeholders[j] = "?"
+			args = append(args, path)
+		}
+		for _, path := range batch {
+			args = append(args, path)
+		}
+		in := strings.Join(placeholders, ",")
+		collate := collateClause(config)
+
+		query := fmt.Sprintf(
+			"SELECT e.sku FROM %s e JOIN %s l ON l.entity_id = e.entity_id "+
+				"JOIN %s g ON g.value_id = l.value_id WHERE g.value%s IN (%s) "+
+				"UNION SELECT e.sku FROM %s e JOIN %s v ON v.entity_id = e.entity_id WHERE v.value%s IN (%s)",
+			productTable, linkTable, galleryTable, collate, in, productTable, varcharTable, collate, in)
+
+		rows, err := dbQuery(db, query, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var sku string
+			if err := rows.Scan(&sku); err != nil {
+				continue
 			}
+			skus[sku] = true
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
 		}
 	}
+
+	return nil
 }
 
-func processFileLocal(fullPath, basePath string, stats *Stats,
-	filesMap map[string]FileInfo, hashMap map[uint64][]FileInfo) {
+// getProductImagePaths returns all image paths referenced by the products with
+// the given SKUs, through the media gallery or an image attribute
+func getProductImagePaths(db *sql.DB, config Config, skus []string) (map[string]bool, error) {
+	productTable := config.DBTablePrefix + "catalog_product_entity"
+	varcharTable := config.DBTablePrefix + "catalog_product_entity_varchar"
+	galleryTable := config.DBTablePrefix + "catalog_product_entity_media_gallery"
+	linkTable := config.DBTablePrefix + "catalog_product_entity_media_gallery_value_to_entity"
 
-	relPath := strings.TrimPrefix(fullPath, basePath)
-	if relPath == "" {
-		return
-	}
+	paths := make(map[string]bool)
 
-	// Skip cache directory
-	if strings.HasPrefix(relPath, "/cache/") || strings.HasPrefix(relPath, "cache/") {
-		atomic.AddInt64(&stats.CachedFiles, 1)
-		return
-	}
+	const batchSize = 5000
+	for i := 0; i < len(skus); i += batchSize {
+		end := i + batchSize
+		if end > len(skus) {
+			end = len(skus)
+		}
 
-	// Calculate hash
-	hash, err := hashFile(fullPath)
-	if err != nil {
-		return
-	}
+		batch := skus[i:end]
+		placeholders := make([]string, len(batch))
+		args := make([]interface{}, 0, len(batch)*2)
+		for j, sku := range batch {
+			placeholders[j] = "?"
+			args = append(args, sku)
+		}
+		for _, sku := range batch {
+			args = append(args, sku)
+		}
+		in := strings.Join(placeholders, ",")
 
-	info, err := os.Stat(fullPath)
-	if err != nil {
-		return
-	}
+		query := fmt.Sprintf(
+			"SELECT g.value FROM %s e JOIN %s l ON l.entity_id = e.entity_id "+
+				"JOIN %s g ON g.value_id = l.value_id WHERE e.sku IN (%s) "+
+				"UNION SELECT v.value FROM %s e JOIN %s v ON v.entity_id = e.entity_id "+
+				"WHERE e.sku IN (%s) AND v.value LIKE '/%%'",
+			productTable, linkTable, galleryTable, in, productTable, varcharTable, in)
 
-	fileInfo := FileInfo{
-		RelativePath: relPath,
-		Hash:         hash,
-		Size:         info.Size(),
+		rows, err := dbQuery(db, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var value sql.NullString
+			if err := rows.Scan(&value); err != nil || !value.Valid {
+				continue
+			}
+			paths[value.String] = true
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// No mutex needed - worker-local maps
-	atomic.AddInt64(&stats.TotalFiles, 1)
-	filesMap[relPath] = fileInfo
-	hashMap[hash] = append(hashMap[hash], fileInfo)
+	return paths, nil
 }
 
-func hashFile(path string) (uint64, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return 0, err
-	}
-	defer f.Close()
+// getAttributeSetImagePaths returns the gallery and image attribute paths of
+// all products in the attribute sets setIDs
+func getAttributeSetImagePaths(db *sql.DB, config Config, setIDs []int64) (map[string]bool, error) {
+	productTable := config.DBTablePrefix + "catalog_product_entity"
+	varcharTable := config.DBTablePrefix + "catalog_product_entity_varchar"
+	galleryTable := config.DBTablePrefix + "catalog_product_entity_media_gallery"
+	linkTable := config.DBTablePrefix + "catalog_product_entity_media_gallery_value_to_entity"
 
-	h := xxhash.New()
-	// Hash only the first 4 MB for performance
-	limitedReader := io.LimitReader(f, 4<<20)
-	if _, err := io.Copy(h, limitedReader); err != nil {
-		return 0, err
+	placeholders := make([]string, len(setIDs))
+	args := make([]interface{}, 0, len(setIDs)*2)
+	for i, id := range setIDs {
+		placeholders[i] = "?"
+		args = append(args, id)
 	}
+	for _, id := range setIDs {
+		args = append(args, id)
+	}
+	in := strings.Join(placeholders, ",")
 
-	return h.Sum64(), nil
-}
-
-func getMediaGalleryPaths(db *sql.DB, config Config) ([]string, error) {
-	tableName := config.DBTablePrefix + "catalog_product_entity_media_gallery"
-	query := fmt.Sprintf("SELECT value FROM %s", tableName)
+	query := fmt.Sprintf(
+		"SELECT g.value FROM %s e JOIN %s l ON l.entity_id = e.entity_id "+
+			"JOIN %s g ON g.value_id = l.value_id WHERE e.attribute_set_id IN (%s) "+
+			"UNION SELECT v.value FROM %s e JOIN %s v ON v.entity_id = e.entity_id "+
+			"WHERE e.attribute_set_id IN (%s) AND v.value LIKE '/%%'",
+		productTable, linkTable, galleryTable, in, productTable, varcharTable, in)
 
-	rows, err := db.Query(query)
+	rows, err := dbQuery(db, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var paths []string
+	paths := make(map[string]bool)
 	for rows.Next() {
-		var value string
-		if err := rows.Scan(&value); err != nil {
+		var value sql.NullString
+		if err := rows.Scan(&value); err != nil || !value.Valid {
 			continue
 		}
-		paths = append(paths, value)
+		paths[value.String] = true
 	}
-
-	return paths, nil
+	return paths, rows.Err()
 }
 
-func removeOrphanedRows(db *sql.DB, config Config, missingFiles []string) (int64, error) {
-	if len(missingFiles) == 0 {
-		return 0, nil
+// readSKUList merges a comma separated SKU list and a file with one SKU per
+// line, skipping blank lines and # comments
+func readSKUList(list, file string) ([]string, error) {
+	seen := make(map[string]bool)
+	var skus []string
+	add := func(sku string) {
+		sku = strings.TrimSpace(sku)
+		if sku != "" && !seen[sku] {
+			seen[sku] = true
+			skus = append(skus, sku)
+		}
 	}
 
-	tableName := config.DBTablePrefix + "catalog_product_entity_media_gallery"
-
-	// Process in batches to avoid "too many placeholders" error
-	// MySQL max placeholders is 65535, use 5000 for safety
-	const batchSize = 5000
-	var totalAffected int64
+	for _, sku := range strings.Split(list, ",") {
+		add(sku)
+	}
 
-	for i := 0; i < len(missingFiles); i += batchSize {
-		end := i + batchSize
-		if end > len(missingFiles) {
-			end = len(missingFiles)
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
 		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+				add(line)
+			}
+		}
+	}
 
-		batch := missingFiles[i:end]
+	return skus, nil
+}
 
-		// Build IN clause for this batch
-		placeholders := make([]string, len(batch))
-		args := make([]interface{}, len(batch))
-		for j, file := range batch {
-			placeholders[j] = "?"
-			args[j] = file
-		}
+// writeImportScript writes a shell script that regenerates the image cache and
+// reindexes product attributes for the modified products. The script is only
+// generated here; no Magento command is executed by this tool.
+func writeImportScript(path, magentoRoot string, skus []string) error {
+	if magentoRoot == "" {
+		magentoRoot = "."
+	}
 
-		query := fmt.Sprintf("DELETE FROM %s WHERE value IN (%s)",
-			tableName, strings.Join(placeholders, ","))
+	quoted := make([]string, len(skus))
+	for i, sku := range skus {
+		quoted[i] = shellQuote(sku)
+	}
 
-		result, err := db.Exec(query, args...)
-		if err != nil {
-			return totalAffected, err
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	fmt.Fprintf(&b, "# Generated by magento2-media-cleaner on %s\n", time.Now().Format(time.RFC3339))
+	b.WriteString("set -e\n\n")
+	fmt.Fprintf(&b, "cd %s\n\n", shellQuote(magentoRoot))
+	b.WriteString("# Products modified by the cleanup run\n")
+	fmt.Fprintf(&b, "MODIFIED_SKUS=%s\n", shellQuote(strings.Join(skus, ",")))
+	b.WriteString("export MODIFIED_SKUS\n\n")
+	if len(skus) > 0 {
+		b.WriteString("printf '%s\\n' \\\n")
+		for i, sku := range quoted {
+			if i < len(quoted)-1 {
+				fmt.Fprintf(&b, "  %s \\\n", sku)
+			} else {
+				fmt.Fprintf(&b, "  %s > modified-skus.txt\n\n", sku)
+			}
 		}
+	}
+	b.WriteString("# Resize only the modified products if this Magento version supports it\n")
+	b.WriteString("if bin/magento catalog:images:resize --help 2>/dev/null | grep -q -- '--sku'; then\n")
+	b.WriteString("  bin/magento catalog:images:resize --sku=\"$MODIFIED_SKUS\"\n")
+	b.WriteString("else\n")
+	b.WriteString("  bin/magento catalog:images:resize\n")
+	b.WriteString("fi\n\n")
+	b.WriteString("bin/magento indexer:reindex catalog_product_attribute\n")
+
+	return os.WriteFile(path, []byte(b.String()), 0755)
+}
 
-		affected, _ := result.RowsAffected()
-		totalAffected += affected
+// shellQuote wraps s in single quotes so it can be used as a literal shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
 
-		fmt.Printf("Processed batch %d-%d: removed %d rows\n", i+1, end, affected)
+// statsSchemaVersion is written to the json and csv stats. Increment it
+// whenever keys are renamed or removed or their meaning changes.
+const statsSchemaVersion = "1.0"
+
+// Write writes the summary to w as text, the format printed at the end of
+// every run, or as json or csv with every counter, including the zero ones
+func (s *Stats) Write(w io.Writer, format string) error {
+	var b bytes.Buffer
+	switch format {
+	case "text":
+		s.writeText(&b)
+	case "json":
+		fmt.Fprintf(&b, "{\n  \"schema_version\": %q", statsSchemaVersion)
+		for _, v := range s.values() {
+			fmt.Fprintf(&b, ",\n  %q: %d", v.name, v.value)
+		}
+		b.WriteString(",\n  \"operation_timings_ms\": {")
+		for i, name := range s.timingNames {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(&b, "\n    %q: %d", name, s.OperationTimings[name].Milliseconds())
+		}
+		if len(s.timingNames) > 0 {
+			b.WriteString("\n  ")
+		}
+		b.WriteString("}")
+		b.WriteString("\n}\n")
+	case "ndjson":
+		fmt.Fprintf(&b, `{"type":"stats","schema_version":%q`, statsSchemaVersion)
+		for _, v := range s.values() {
+			fmt.Fprintf(&b, ",%q:%d", v.name, v.value)
+		}
+		b.WriteString(`,"operation_timings_ms":{`)
+		for i, name := range s.timingNames {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(&b, "%q:%d", name, s.OperationTimings[name].Milliseconds())
+		}
+		b.WriteString("}}\n")
+	case "csv":
+		fmt.Fprintf(&b, "# schema_version: %s\n", statsSchemaVersion)
+		cw := csv.NewWriter(&b)
+		cw.Write([]string{"name", "value"})
+		for _, v := range s.values() {
+			cw.Write([]string{v.name, strconv.FormatInt(v.value, 10)})
+		}
+		for _, name := range s.timingNames {
+			cw.Write([]string{"timing_" + name + "_ms", strconv.FormatInt(s.OperationTimings[name].Milliseconds(), 10)})
+		}
+		cw.Flush()
+	default:
+		return fmt.Errorf("unknown stats format %q", format)
 	}
-
-	return totalAffected, nil
+	_, err := w.Write(b.Bytes())
+	return err
 }
 
-func updateDatabaseForDuplicatesBatch(db *sql.DB, config Config, mappings []DuplicateMapping) (int64, int64, error) {
-	if len(mappings) == 0 {
-		return 0, 0, nil
+// addTiming adds d to the time spent on the named step. Not safe for
+// concurrent use, call it from the goroutine that runs the step.
+func (s *Stats) addTiming(name string, d time.Duration) {
+	if s.OperationTimings == nil {
+		s.OperationTimings = make(map[string]time.Duration)
 	}
+	if _, ok := s.OperationTimings[name]; !ok {
+		s.timingNames = append(s.timingNames, name)
+	}
+	s.OperationTimings[name] += d
+}
 
-	varcharTable := config.DBTablePrefix + "catalog_product_entity_varchar"
-	galleryTable := config.DBTablePrefix + "catalog_product_entity_media_gallery"
+// writeTimings writes the --verbose table of OperationTimings
+func (s *Stats) writeTimings(w io.Writer) {
+	if len(s.timingNames) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "\nOperation timings:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tTIME")
+	for _, name := range s.timingNames {
+		fmt.Fprintf(tw, "%s\t%v\n", name, s.OperationTimings[name].Round(time.Millisecond))
+	}
+	tw.Flush()
+}
 
-	// Build SQL for batch updates
-	varcharSQL, varcharArgs := buildBatchUpdateSQL(varcharTable, mappings)
-	gallerySQL, galleryArgs := buildBatchUpdateSQL(galleryTable, mappings)
+type statValue struct {
+	name  string
+	value int64
+}
 
-	// Start transaction
-	tx, err := db.Begin()
-	if err != nil {
-		return 0, 0, fmt.Errorf("failed to begin transaction: %v", err)
+// values lists the counters in the order of the text summary, durations are
+// in milliseconds
+func (s *Stats) values() []statValue {
+	return []statValue{
+		{"gallery_entries", int64(s.GalleryEntries)},
+		{"total_files", s.TotalFiles},
+		{"cached_files", s.CachedFiles},
+		{"unused_files", s.UnusedFiles},
+		{"missing_files", s.MissingFiles},
+		{"duplicate_files", s.DuplicateFiles},
+		{"orphan_cache_files", s.OrphanCacheFiles},
+		{"distinct_hashes", s.DistinctHashes},
+		{"metadata_files", s.MetadataFiles},
+		{"overcrowded_dirs", s.OvercrowdedDirs},
+		{"mismatched_headers", s.MismatchedHeaders},
+		{"watermark_files", s.WatermarkFiles},
+		{"swatch_files", s.SwatchFiles},
+		{"unused_swatches", s.UnusedSwatches},
+		{"customer_files", s.CustomerFiles},
+		{"unused_customer_files", s.UnusedCustomerFiles},
+		{"import_files", s.ImportFiles},
+		{"unused_import_files", s.UnusedImportFiles},
+		{"in_both_tables", s.InBothTables},
+		{"varchar_only", s.VarcharOnly},
+		{"gallery_only", s.GalleryOnly},
+		{"null_gallery_values", s.NullGalleryValues},
+		{"removed_unused", s.RemovedUnused},
+		{"remaining_unused", s.RemainingUnused},
+		{"removed_orphans", s.RemovedOrphans},
+		{"removed_swatches", s.RemovedSwatches},
+		{"removed_customer_files", s.RemovedCustomerFiles},
+		{"removed_import_files", s.RemovedImportFiles},
+		{"removed_metadata", s.RemovedMetadata},
+		{"removed_orphan_cache", s.RemovedOrphanCache},
+		{"fixed_path_encoding", s.FixedPathEncoding},
+		{"store_specific_images", s.StoreSpecificImages},
+		{"split_image_groups", s.SplitImageGroups},
+		{"external_video_entries", s.ExternalVideoEntries},
+		{"local_video_entries", s.LocalVideoEntries},
+		{"skipped_unwritable", s.SkippedUnwritable},
+		{"removed_duplicates", s.RemovedDuplicates},
+		{"updated_varchar", s.UpdatedVarchar},
+		{"updated_gallery", s.UpdatedGallery},
+		{"dangling_links", s.DanglingLinks},
+		{"removed_dangling_links", s.RemovedDanglingLinks},
+		{"removed_null_gallery", s.RemovedNullGallery},
+		{"empty_gallery_values", s.EmptyGalleryValues},
+		{"removed_empty_gallery", s.RemovedEmptyGallery},
+		{"reordered_gallery_rows", s.ReorderedGalleryRows},
+		{"inserted_gallery", s.InsertedGallery},
+		{"missing_gallery_rows", s.MissingGalleryRows},
+		{"failed_removals", s.FailedRemovals},
+		{"failed_operations", s.FailedOperations},
+		{"bytes_freed", s.BytesFreed},
+		{"hashed_files", s.HashedFiles},
+		{"scan_ms", s.ScanDuration.Milliseconds()},
+		{"db_query_ms", s.DBDuration.Milliseconds()},
+		{"total_ms", s.TotalDuration.Milliseconds()},
+		{"peak_memory", s.PeakMemory},
 	}
-	defer tx.Rollback() // Rollback if not committed
+}
 
-	// Update varchar table
-	vResult, err := tx.Exec(varcharSQL, varcharArgs...)
-	if err != nil {
-		return 0, 0, fmt.Errorf("failed to update varchar table: %v", err)
+// writeCounts writes the --count-only line, or a flat JSON object for the
+// json format
+func writeCounts(w io.Writer, s *Stats, format string) {
+	counts := []statValue{
+		{"unused", s.UnusedFiles},
+		{"missing", s.MissingFiles},
+		{"duplicates", s.DuplicateFiles},
+		{"db_entries", int64(s.GalleryEntries)},
+		{"total_files", s.TotalFiles},
 	}
-	vRows, _ := vResult.RowsAffected()
-
-	// Update gallery table
-	gResult, err := tx.Exec(gallerySQL, galleryArgs...)
-	if err != nil {
-		return vRows, 0, fmt.Errorf("failed to update gallery table: %v", err)
+	parts := make([]string, len(counts))
+	for i, c := range counts {
+		if format == "json" || format == "ndjson" {
+			parts[i] = fmt.Sprintf("%q:%d", c.name, c.value)
+		} else {
+			parts[i] = fmt.Sprintf("%s=%d", c.name, c.value)
+		}
 	}
-	gRows, _ := gResult.RowsAffected()
-
-	// Commit transaction
-	if err := tx.Commit(); err != nil {
-		return vRows, gRows, fmt.Errorf("failed to commit transaction: %v", err)
+	if format == "json" || format == "ndjson" {
+		fmt.Fprintf(w, "{%s}\n", strings.Join(parts, ","))
+		return
 	}
-
-	return vRows, gRows, nil
+	fmt.Fprintln(w, strings.Join(parts, " "))
 }
 
-func buildBatchUpdateSQL(tableName string, mappings []DuplicateMapping) (string, []interface{}) {
-	var caseClauses []string
-	var whereValues []string
-	var args []interface{}
+// writeText writes the human readable summary
+func (s *Stats) writeText(w io.Writer) {
+	fmt.Fprintln(w, "\n"+strings.Repeat("=", 50))
+	fmt.Fprintf(w, "Media Gallery entries: %d\n", s.GalleryEntries)
+	fmt.Fprintf(w, "Files in directory: %d\n", s.TotalFiles)
+	fmt.Fprintf(w, "Cached images: %d (not included in total)\n", s.CachedFiles)
+	if s.OrphanCacheFiles > 0 {
+		fmt.Fprintf(w, "Cached images without source image: %d\n", s.OrphanCacheFiles)
+	}
+	fmt.Fprintf(w, "Unused files: %d\n", s.UnusedFiles)
+	fmt.Fprintf(w, "Missing files: %d\n", s.MissingFiles)
+	fmt.Fprintf(w, "Duplicated files: %d\n", s.DuplicateFiles)
+	if s.DistinctHashes > 0 {
+		fmt.Fprintf(w, "Unique image contents: %d out of %d total files (%.1f%% duplication ratio)\n",
+			s.DistinctHashes, s.TotalFiles, float64(s.DuplicateFiles)*100/float64(s.TotalFiles))
+	}
+	if s.MetadataFiles > 0 {
+		fmt.Fprintf(w, "Metadata files: %d\n", s.MetadataFiles)
+	}
+	if s.OvercrowdedDirs > 0 {
+		fmt.Fprintf(w, "Overcrowded directories: %d\n", s.OvercrowdedDirs)
+	}
+	if s.MismatchedHeaders > 0 {
+		fmt.Fprintf(w, "Mismatched image headers: %d\n", s.MismatchedHeaders)
+	}
+	if s.WatermarkFiles > 0 {
+		fmt.Fprintf(w, "Watermark files (not included in total): %d\n", s.WatermarkFiles)
+	}
+	if s.StoreSpecificImages > 0 {
+		fmt.Fprintf(w, "Store specific images: %d\n", s.StoreSpecificImages)
+	}
+	if s.SplitImageGroups > 0 {
+		fmt.Fprintf(w, "Split images (size variants protected): %d\n", s.SplitImageGroups)
+	}
+	if s.ExternalVideoEntries > 0 || s.LocalVideoEntries > 0 {
+		fmt.Fprintf(w, "Video entries: %d external, %d local\n", s.ExternalVideoEntries, s.LocalVideoEntries)
+	}
+	if s.SwatchFiles > 0 {
+		fmt.Fprintf(w, "Swatch images: %d\n", s.SwatchFiles)
+		fmt.Fprintf(w, "Unused swatch images: %d\n", s.UnusedSwatches)
+	}
+	if s.CustomerFiles > 0 {
+		fmt.Fprintf(w, "Customer uploads: %d\n", s.CustomerFiles)
+		fmt.Fprintf(w, "Unused customer uploads: %d\n", s.UnusedCustomerFiles)
+	}
+	if s.ImportFiles > 0 {
+		fmt.Fprintf(w, "Import images: %d\n", s.ImportFiles)
+		fmt.Fprintf(w, "Unused import images: %d\n", s.UnusedImportFiles)
+	}
+	fmt.Fprintf(w, "Paths in gallery and image attributes: %d\n", s.InBothTables)
+	fmt.Fprintf(w, "Paths only in image attributes: %d\n", s.VarcharOnly)
+	fmt.Fprintf(w, "Paths only in gallery: %d\n", s.GalleryOnly)
+	if s.NullGalleryValues > 0 {
+		fmt.Fprintf(w, "NULL gallery values: %d\n", s.NullGalleryValues)
+	}
+	if s.EmptyGalleryValues > 0 {
+		fmt.Fprintf(w, "Empty gallery values: %d\n", s.EmptyGalleryValues)
+	}
+	fmt.Fprintln(w, strings.Repeat("=", 50))
 
-	for _, mapping := range mappings {
-		// CASE WHEN value = ? THEN ?
-		caseClauses = append(caseClauses, "WHEN ? THEN ?")
-		args = append(args, mapping.Duplicate, mapping.Original)
+	if s.RemovedUnused > 0 {
+		fmt.Fprintf(w, "Removed unused files: %d\n", s.RemovedUnused)
+	}
+	if s.RemainingUnused > 0 {
+		fmt.Fprintf(w, "Remaining unused files: %d\n", s.RemainingUnused)
+	}
+	if s.RemovedOrphans > 0 {
+		fmt.Fprintf(w, "Removed orphaned rows: %d\n", s.RemovedOrphans)
+	}
+	if s.RemovedSwatches > 0 {
+		fmt.Fprintf(w, "Removed swatch images: %d\n", s.RemovedSwatches)
+	}
+	if s.RemovedCustomerFiles > 0 {
+		fmt.Fprintf(w, "Removed customer uploads: %d\n", s.RemovedCustomerFiles)
+	}
+	if s.RemovedImportFiles > 0 {
+		fmt.Fprintf(w, "Removed import images: %d\n", s.RemovedImportFiles)
+	}
+	if s.RemovedMetadata > 0 {
+		fmt.Fprintf(w, "Removed metadata files: %d\n", s.RemovedMetadata)
+	}
+	if s.FixedPathEncoding > 0 {
+		fmt.Fprintf(w, "Renamed to NFC paths: %d\n", s.FixedPathEncoding)
+	}
+	if s.SkippedUnwritable > 0 {
+		fmt.Fprintf(w, "Skipped in unwritable directories: %d\n", s.SkippedUnwritable)
+	}
+	if s.RemovedOrphanCache > 0 {
+		fmt.Fprintf(w, "Removed cached images: %d\n", s.RemovedOrphanCache)
+	}
+	if s.RemovedDuplicates > 0 {
+		fmt.Fprintf(w, "Removed duplicated files: %d\n", s.RemovedDuplicates)
+		fmt.Fprintf(w, "Updated catalog_product_entity_varchar rows: %d\n", s.UpdatedVarchar)
+		fmt.Fprintf(w, "Updated catalog_product_entity_media_gallery rows: %d\n", s.UpdatedGallery)
+	}
+	if s.MissingGalleryRows > 0 {
+		fmt.Fprintf(w, "Image roles without gallery row: %d\n", s.MissingGalleryRows)
+	}
+	if s.DanglingLinks > 0 {
+		fmt.Fprintf(w, "Dangling gallery value links: %d\n", s.DanglingLinks)
+	}
+	if s.RemovedDanglingLinks > 0 {
+		fmt.Fprintf(w, "Removed dangling gallery value links: %d\n", s.RemovedDanglingLinks)
+	}
+	if s.RemovedNullGallery > 0 {
+		fmt.Fprintf(w, "Removed NULL gallery rows: %d\n", s.RemovedNullGallery)
+	}
+	if s.RemovedEmptyGallery > 0 {
+		fmt.Fprintf(w, "Removed empty gallery rows: %d\n", s.RemovedEmptyGallery)
+	}
+	if s.ReorderedGalleryRows > 0 {
+		fmt.Fprintf(w, "Renumbered gallery positions: %d\n", s.ReorderedGalleryRows)
+	}
+	if s.InsertedGallery > 0 {
+		fmt.Fprintf(w, "Inserted catalog_product_entity_media_gallery rows: %d\n", s.InsertedGallery)
+	}
+	if s.FailedRemovals > 0 {
+		fmt.Fprintf(w, "Files still present after removal: %d\n", s.FailedRemovals)
+	}
+	if s.FailedOperations > 0 {
+		fmt.Fprintf(w, "Failed file operations: %d\n", s.FailedOperations)
+	}
+	if s.BytesFreed > 0 {
+		fmt.Fprintf(w, "Disk space freed: %.2f MB\n", float64(s.BytesFreed)/1024/1024)
+	}
+	fmt.Fprintln(w, strings.Repeat("=", 50))
 
-		// WHERE value IN (?, ...)
-		whereValues = append(whereValues, "?")
-		args = append(args, mapping.Duplicate)
+	// Performance timing
+	fmt.Fprintln(w, "\nPerformance:")
+	fmt.Fprintf(w, "Filesystem scan: %v\n", s.ScanDuration.Round(time.Millisecond))
+	fmt.Fprintf(w, "Database query: %v\n", s.DBDuration.Round(time.Millisecond))
+	fmt.Fprintf(w, "Total time: %v\n", s.TotalDuration.Round(time.Millisecond))
+	if s.PeakMemory > 0 {
+		fmt.Fprintf(w, "Peak memory used: %.2f GB\n", float64(s.PeakMemory)/(1<<30))
 	}
 
-	sql := fmt.Sprintf(
-		"UPDATE %s SET value = CASE value %s END WHERE value IN (%s)",
-		tableName,
-		strings.Join(caseClauses, " "),
-		strings.Join(whereValues, ", "),
-	)
+	if s.TotalFiles > 0 && s.ScanDuration > 0 {
+		filesPerSecond := float64(s.TotalFiles) / s.ScanDuration.Seconds()
+		fmt.Fprintf(w, "Files processed: %.0f files/second\n", filesPerSecond)
+		fmt.Fprintf(w, "Files hashed: %d of %d (size pre-filter)\n", s.HashedFiles, s.TotalFiles)
+	}
 
-	return sql, args
+	fmt.Fprintln(w, strings.Repeat("=", 50))
 }
 
-func printStats(stats *Stats, dbEntries int, scanDuration, dbDuration, totalDuration time.Duration) {
-	fmt.Println("\n" + strings.Repeat("=", 50))
-	fmt.Printf("Media Gallery entries: %d\n", dbEntries)
-	fmt.Printf("Files in directory: %d\n", stats.TotalFiles)
-	fmt.Printf("Cached images: %d\n", stats.CachedFiles)
-	fmt.Printf("Unused files: %d\n", stats.UnusedFiles)
-	fmt.Printf("Missing files: %d\n", stats.MissingFiles)
-	fmt.Printf("Duplicated files: %d\n", stats.DuplicateFiles)
-	fmt.Println(strings.Repeat("=", 50))
+// ageBuckets are the modification age ranges used by
+// --report-file-age-distribution, the last bucket is open-ended
+var ageBuckets = []struct {
+	label  string
+	maxAge time.Duration
+}{
+	{"<7d", 7 * 24 * time.Hour},
+	{"7-30d", 30 * 24 * time.Hour},
+	{"30-90d", 90 * 24 * time.Hour},
+	{"90-365d", 365 * 24 * time.Hour},
+	{">1y", 0},
+}
 
-	if stats.RemovedUnused > 0 {
-		fmt.Printf("Removed unused files: %d\n", stats.RemovedUnused)
-	}
-	if stats.RemovedOrphans > 0 {
-		fmt.Printf("Removed orphaned rows: %d\n", stats.RemovedOrphans)
+// ageBucket returns the index in ageBuckets for a file modified at modTime
+func ageBucket(modTime, now time.Time) int {
+	age := now.Sub(modTime)
+	for i, bucket := range ageBuckets {
+		if bucket.maxAge == 0 || age < bucket.maxAge {
+			return i
+		}
 	}
-	if stats.RemovedDuplicates > 0 {
-		fmt.Printf("Removed duplicated files: %d\n", stats.RemovedDuplicates)
-		fmt.Printf("Updated catalog_product_entity_varchar rows: %d\n", stats.UpdatedVarchar)
-		fmt.Printf("Updated catalog_product_entity_media_gallery rows: %d\n", stats.UpdatedGallery)
+	return len(ageBuckets) - 1
+}
+
+func printAgeDistribution(filesMap map[string]FileInfo, unusedFiles []string) {
+	now := time.Now()
+	counts := make([]int64, len(ageBuckets))
+	sizes := make([]int64, len(ageBuckets))
+	unusedCounts := make([]int64, len(ageBuckets))
+	unusedSizes := make([]int64, len(ageBuckets))
+
+	for _, file := range filesMap {
+		i := ageBucket(file.ModTime, now)
+		counts[i]++
+		sizes[i] += file.Size
 	}
-	if stats.BytesFreed > 0 {
-		fmt.Printf("Disk space freed: %.2f MB\n", float64(stats.BytesFreed)/1024/1024)
+	for _, path := range unusedFiles {
+		file := filesMap[path]
+		i := ageBucket(file.ModTime, now)
+		unusedCounts[i]++
+		unusedSizes[i] += file.Size
 	}
-	fmt.Println(strings.Repeat("=", 50))
 
-	// Performance timing
-	fmt.Println("\nPerformance:")
-	fmt.Printf("Filesystem scan: %v\n", scanDuration.Round(time.Millisecond))
-	fmt.Printf("Database query: %v\n", dbDuration.Round(time.Millisecond))
-	fmt.Printf("Total time: %v\n", totalDuration.Round(time.Millisecond))
-
-	if stats.TotalFiles > 0 && scanDuration > 0 {
-		filesPerSecond := float64(stats.TotalFiles) / scanDuration.Seconds()
-		fmt.Printf("Files processed: %.0f files/second\n", filesPerSecond)
+	fmt.Fprintln(stdout, "\nFile age distribution:")
+	fmt.Fprintf(stdout, "%-8s | %10s | %12s | %10s | %12s\n", "age", "files", "size (MB)", "unused", "unused (MB)")
+	fmt.Fprintln(stdout, strings.Repeat("-", 64))
+	for i, bucket := range ageBuckets {
+		fmt.Fprintf(stdout, "%-8s | %10d | %12.2f | %10d | %12.2f\n", bucket.label,
+			counts[i], float64(sizes[i])/1024/1024, unusedCounts[i], float64(unusedSizes[i])/1024/1024)
 	}
+}
 
-	fmt.Println(strings.Repeat("=", 50))
+// printBenchmark reports scan throughput and a tuning hint for --benchmark.
+// Stat and hash times are summed over all workers of each pool.
+func printBenchmark(stats *Stats, config Config, scanDuration time.Duration) {
+	statTime := time.Duration(stats.StatNanos)
+	hashTime := time.Duration(stats.HashNanos)
+
+	fmt.Fprintln(stdout, "\n"+strings.Repeat("=", 50))
+	fmt.Fprintf(stdout, "Files scanned: %d\n", stats.TotalFiles)
+	fmt.Fprintf(stdout, "Files hashed: %d\n", stats.HashedFiles)
+	fmt.Fprintf(stdout, "Bytes hashed: %.2f MB\n", float64(stats.HashedBytes)/1024/1024)
+	fmt.Fprintf(stdout, "Scan time: %v\n", scanDuration.Round(time.Millisecond))
+	if scanDuration > 0 {
+		fmt.Fprintf(stdout, "Throughput: %.0f files/second, %.2f MB/second\n",
+			float64(stats.TotalFiles)/scanDuration.Seconds(),
+			float64(stats.HashedBytes)/1024/1024/scanDuration.Seconds())
+	}
+	fmt.Fprintf(stdout, "Stat time (all workers): %v\n", statTime.Round(time.Millisecond))
+	fmt.Fprintf(stdout, "Hash time (all workers): %v\n", hashTime.Round(time.Millisecond))
+	if stats.TotalFiles > 0 {
+		fmt.Fprintf(stdout, "Average stat: %v per file\n", (statTime / time.Duration(stats.TotalFiles)).Round(time.Microsecond))
+	}
+	if stats.HashedFiles > 0 {
+		fmt.Fprintf(stdout, "Average hash: %v per file\n", (hashTime / time.Duration(stats.HashedFiles)).Round(time.Microsecond))
+	}
+	fmt.Fprintln(stdout, strings.Repeat("=", 50))
+
+	fmt.Fprintln(stdout, "\nRecommendation:")
+	switch {
+	case stats.TotalFiles == 0:
+		fmt.Fprintln(stdout, "No files found, nothing to tune.")
+	case statTime > hashTime:
+		fmt.Fprintln(stdout, "The scan is dominated by file metadata I/O (os.Stat, os.ReadDir).")
+		fmt.Fprintln(stdout, "Try increasing --workers and --walker-workers, especially on network storage.")
+	case config.HashWorkers < runtime.NumCPU():
+		fmt.Fprintln(stdout, "The scan is dominated by hashing.")
+		fmt.Fprintf(stdout, "Try raising --hash-workers towards the number of CPU cores (%d).\n", runtime.NumCPU())
+	default:
+		fmt.Fprintln(stdout, "The scan is dominated by hashing and --hash-workers already matches the CPU count.")
+		fmt.Fprintln(stdout, "Storage read throughput is the likely limit, lowering --hash-workers can reduce seek thrashing on HDDs.")
+	}
 }
 
 func findMagentoRoot(startPath string) (string, error) {
@@ -822,17 +6250,26 @@ func findMagentoRoot(startPath string) (string, error) {
 	}
 }
 
-func parseEnvPHP(envPath string) (map[string]interface{}, error) {
+// parseEnvPHP extracts the table prefix and the credentials of the named
+// connection (e.g. "default") from the 'db' section of env.php
+func parseEnvPHP(envPath, connection string) (map[string]interface{}, error) {
 	content, err := os.ReadFile(envPath)
 	if err != nil {
 		return nil, err
 	}
 
+	return parseEnvPHPContent(string(content), connection)
+}
+
+// parseEnvPHPContent does the work for parseEnvPHP on the file content. It
+// understands short [] and array() syntax, single and double quoted strings
+// with escapes and ignores PHP comments.
+func parseEnvPHPContent(content, connection string) (map[string]interface{}, error) {
 	result := make(map[string]interface{})
-	text := string(content)
+	text := stripPHPComments(content)
 
 	// Find the 'db' section - need to handle nested arrays properly
-	dbStart := strings.Index(text, "'db' =>")
+	dbStart := findArrayKey(text, "db")
 	if dbStart == -1 {
 		return result, fmt.Errorf("'db' section not found in env.php")
 	}
@@ -842,73 +6279,141 @@ func parseEnvPHP(envPath string) (map[string]interface{}, error) {
 	dbSection := extractBalancedSection(text[dbStart:])
 
 	// Extract table_prefix from db section
-	prefixPattern := regexp.MustCompile(`'table_prefix'\s*=>\s*'([^']*)'`)
-	prefixMatch := prefixPattern.FindStringSubmatch(dbSection)
-	if len(prefixMatch) > 1 {
-		result["table_prefix"] = prefixMatch[1]
-	} else {
-		result["table_prefix"] = ""
-	}
+	result["table_prefix"] = extractValue(dbSection, "table_prefix")
 
-	// Find connection -> default section
-	connStart := strings.Index(dbSection, "'connection' =>")
+	// Find connection -> <connection> section
+	connStart := findArrayKey(dbSection, "connection")
 	if connStart == -1 {
 		return result, fmt.Errorf("'connection' section not found in env.php")
 	}
 
 	connSection := extractBalancedSection(dbSection[connStart:])
 
-	defaultStart := strings.Index(connSection, "'default' =>")
-	if defaultStart == -1 {
-		return result, fmt.Errorf("'default' connection not found in env.php")
+	namedStart := findArrayKey(connSection, connection)
+	if namedStart == -1 {
+		return result, fmt.Errorf("'%s' connection not found in env.php", connection)
 	}
 
-	defaultSection := extractBalancedSection(connSection[defaultStart:])
+	namedSection := extractBalancedSection(connSection[namedStart:])
 
 	// Extract individual fields
-	result["host"] = extractValue(defaultSection, "host")
-	result["dbname"] = extractValue(defaultSection, "dbname")
-	result["username"] = extractValue(defaultSection, "username")
-	result["password"] = extractValue(defaultSection, "password")
+	result["host"] = extractValue(namedSection, "host")
+	result["dbname"] = extractValue(namedSection, "dbname")
+	result["username"] = extractValue(namedSection, "username")
+	result["password"] = extractValue(namedSection, "password")
 
 	return result, nil
 }
 
-// extractBalancedSection extracts content within balanced brackets starting from text
+// findArrayKey returns the offset just after "'key' =>" (either quote style)
+// in text, or -1 if the key is not present
+func findArrayKey(text, key string) int {
+	pattern := regexp.MustCompile(`['"]` + regexp.QuoteMeta(key) + `['"]\s*=>`)
+	loc := pattern.FindStringIndex(text)
+	if loc == nil {
+		return -1
+	}
+	return loc[1]
+}
+
+// stripPHPComments removes //, # and /* */ comments outside of string literals
+func stripPHPComments(text string) string {
+	var b strings.Builder
+	b.Grow(len(text))
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '\'' || c == '"':
+			end := skipQuoted(text, i)
+			b.WriteString(text[i:end])
+			i = end - 1
+		case c == '#' || (c == '/' && i+1 < len(text) && text[i+1] == '/'):
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+			if i < len(text) {
+				b.WriteByte('\n')
+			}
+		case c == '/' && i+1 < len(text) && text[i+1] == '*':
+			end := strings.Index(text[i+2:], "*/")
+			if end == -1 {
+				return b.String()
+			}
+			i += end + 3
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// skipQuoted returns the offset just after the string literal starting at
+// text[start], honouring backslash escapes
+func skipQuoted(text string, start int) int {
+	quote := text[start]
+	for i := start + 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case quote:
+			return i + 1
+		}
+	}
+	return len(text)
+}
+
+// extractBalancedSection extracts content within balanced brackets starting
+// from text. Both [ ] and array( ) are supported and brackets inside string
+// literals are ignored.
 func extractBalancedSection(text string) string {
 	// Find the opening bracket
-	start := strings.Index(text, "[")
+	start := strings.IndexAny(text, "[(")
 	if start == -1 {
 		return ""
 	}
 
 	depth := 0
 	for i := start; i < len(text); i++ {
-		if text[i] == '[' {
+		switch text[i] {
+		case '\'', '"':
+			i = skipQuoted(text, i) - 1
+		case '[', '(':
 			depth++
-		} else if text[i] == ']' {
+		case ']', ')':
 			depth--
 			if depth == 0 {
-				return text[start:i+1]
+				return text[start : i+1]
 			}
 		}
 	}
 	return ""
 }
 
+// extractValue returns the string value of 'key' => 'value' in text. Single
+// and double quoted keys and values are supported, escapes are resolved the
+// way PHP does for the respective quote style.
 func extractValue(text, key string) string {
-	pattern := regexp.MustCompile(fmt.Sprintf(`'%s'\s*=>\s*'([^']*)'`, key))
+	pattern := regexp.MustCompile(`['"]` + regexp.QuoteMeta(key) + `['"]\s*=>\s*(?:'((?:[^'\\]|\\.)*)'|"((?:[^"\\]|\\.)*)")`)
 	match := pattern.FindStringSubmatch(text)
-	if len(match) > 1 {
-		return match[1]
+	if match == nil {
+		return ""
 	}
-	return ""
+	if match[2] != "" {
+		return unescapeDoubleQuoted(match[2])
+	}
+	return strings.NewReplacer(`\\`, `\`, `\'`, `'`).Replace(match[1])
 }
 
-func loadConfigFromEnvPHP(magentoRoot string) (Config, error) {
+// unescapeDoubleQuoted resolves the common escapes of a PHP double quoted string
+func unescapeDoubleQuoted(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\$`, `$`, `\n`, "\n", `\t`, "\t", `\r`, "\r").Replace(s)
+}
+
+func loadConfigFromEnvPHP(magentoRoot, connection string) (Config, error) {
 	envPath := filepath.Join(magentoRoot, "app", "etc", "env.php")
 
-	envData, err := parseEnvPHP(envPath)
+	envData, err := parseEnvPHP(envPath, connection)
 	if err != nil {
 		return Config{}, fmt.Errorf("failed to parse env.php: %v", err)
 	}
@@ -922,11 +6427,16 @@ func loadConfigFromEnvPHP(magentoRoot string) (Config, error) {
 		DBTablePrefix: sanitizeTablePrefix(getStringValue(envData, "table_prefix", "")),
 	}
 
-	// Extract port from host if it contains a colon
+	// Extract port or socket path from host if it contains a colon,
+	// e.g. 'db:3307' or 'localhost:/tmp/mysql.sock'
 	if strings.Contains(config.DBHost, ":") {
-		parts := strings.Split(config.DBHost, ":")
+		parts := strings.SplitN(config.DBHost, ":", 2)
 		config.DBHost = parts[0]
-		config.DBPort = parts[1]
+		if strings.HasPrefix(parts[1], "/") {
+			config.DBSocket = parts[1]
+		} else {
+			config.DBPort = parts[1]
+		}
 	}
 
 	return config, nil
@@ -941,13 +6451,90 @@ func getStringValue(data map[string]interface{}, key, defaultVal string) string
 	return defaultVal
 }
 
-// sanitizeTablePrefix removes any characters that are not alphanumeric or underscore
+// parseBytes parses a human-readable size such as "512", "64KB", "10 MB" or
+// "1.5GB". Units are binary (1 KB = 1024 bytes) and case-insensitive.
+func parseBytes(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	if value == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	multiplier := int64(1)
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"TB", 1 << 40},
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			multiplier = unit.multiplier
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			break
+		}
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	return int64(number * float64(multiplier)), nil
+}
+
+// parseAge parses an age such as "7d" (days), "2w" (weeks) or any
+// time.ParseDuration value like "36h"
+func parseAge(s string) (time.Duration, error) {
+	value := strings.TrimSpace(s)
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(value, suffix) {
+			number, err := strconv.ParseFloat(strings.TrimSuffix(value, suffix), 64)
+			if err != nil || number < 0 {
+				return 0, fmt.Errorf("invalid age %q", s)
+			}
+			return time.Duration(number * float64(unit)), nil
+		}
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return duration, nil
+}
+
+// parseCalendarAge parses a number of days, weeks or months (30 days) such as
+// 30d, 2w or 1m. A plain 0 disables the age filter.
+func parseCalendarAge(s string) (time.Duration, error) {
+	value := strings.TrimSpace(s)
+	if value == "0" {
+		return 0, nil
+	}
+
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour, "m": 30 * 24 * time.Hour}
+	if len(value) < 2 {
+		return 0, fmt.Errorf("invalid age %q (expected e.g. 30d, 2w or 1m)", s)
+	}
+	unit, ok := units[value[len(value)-1:]]
+	number, err := strconv.Atoi(value[:len(value)-1])
+	if !ok || err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid age %q (expected e.g. 30d, 2w or 1m)", s)
+	}
+	return time.Duration(number) * unit, nil
+}
+
+// sanitizeTablePrefix removes any characters that are not ASCII alphanumeric or underscore
 // This prevents SQL injection when the prefix is concatenated into table names
 func sanitizeTablePrefix(prefix string) string {
 	var result strings.Builder
-	for _, r := range prefix {
-		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
-			result.WriteRune(r)
+	for i := 0; i < len(prefix); i++ {
+		c := prefix[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' {
+			result.WriteByte(c)
 		}
 	}
 	return result.String()
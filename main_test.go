@@ -0,0 +1,768 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+var (
+	jpegHeader = []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x10, 'J', 'F', 'I', 'F'}
+	pngHeader  = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, '\n'}
+)
+
+// writeTestFiles creates files below dir, keyed by their path relative to dir
+func writeTestFiles(tb testing.TB, dir string, files map[string][]byte) {
+	tb.Helper()
+	for rel, content := range files {
+		full := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.WriteFile(full, content, 0o644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// newTestMediaDir returns a media directory removed when the test ends
+func newTestMediaDir(tb testing.TB, files map[string][]byte) string {
+	tb.Helper()
+	dir, err := os.MkdirTemp("", "media-cleaner-test-")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+	writeTestFiles(tb, dir, files)
+	return dir
+}
+
+// testScanConfig returns the scan settings Run uses by default
+func testScanConfig(mediaPath string, workers int) Config {
+	return Config{
+		MediaPath:     mediaPath,
+		WorkerCount:   workers,
+		WalkerCount:   workers,
+		HashWorkers:   workers,
+		UniqueBy:      "hash",
+		MmapThreshold: 64 << 20,
+	}
+}
+
+func silenceOutput(tb testing.TB) {
+	tb.Helper()
+	oldStdout, oldStderr := stdout, stderr
+	stdout, stderr = io.Discard, io.Discard
+	tb.Cleanup(func() { stdout, stderr = oldStdout, oldStderr })
+}
+
+func sortedKeys(m map[string]FileInfo) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestScanFilesystem(t *testing.T) {
+	silenceOutput(t)
+
+	duplicate := append(append([]byte{}, jpegHeader...), "same"...)
+	dir := newTestMediaDir(t, map[string][]byte{
+		"a/b/one.jpg":              duplicate,
+		"x/y/copy.jpg":             duplicate,
+		"c/d/other.png":            append(append([]byte{}, pngHeader...), "other"...),
+		"e/f/g/h/i/j/deep.jpg":     append(append([]byte{}, jpegHeader...), "deep"...),
+		"z/empty.jpg":              {},
+		"a/b/notes.txt":            []byte("not an image"),
+		"a/b/.DS_Store":            []byte("metadata"),
+		"cache/0123abcd/a/b/1.jpg": duplicate,
+	})
+
+	stats := &Stats{}
+	result := scanFilesystem(testScanConfig(dir, 4), stats)
+
+	wantFiles := []string{"/a/b/one.jpg", "/c/d/other.png", "/e/f/g/h/i/j/deep.jpg", "/x/y/copy.jpg", "/z/empty.jpg"}
+	if got := sortedKeys(result.FilesMap); !reflect.DeepEqual(got, wantFiles) {
+		t.Errorf("FilesMap = %v, want %v", got, wantFiles)
+	}
+	if stats.TotalFiles != int64(len(wantFiles)) {
+		t.Errorf("TotalFiles = %d, want %d", stats.TotalFiles, len(wantFiles))
+	}
+	if stats.CachedFiles != 1 {
+		t.Errorf("CachedFiles = %d, want 1", stats.CachedFiles)
+	}
+	if want := []string{"/a/b/.DS_Store"}; !reflect.DeepEqual(result.MetadataFiles, want) {
+		t.Errorf("MetadataFiles = %v, want %v", result.MetadataFiles, want)
+	}
+
+	// Only the two files with the same size are hashed
+	one, dup := result.FilesMap["/a/b/one.jpg"], result.FilesMap["/x/y/copy.jpg"]
+	if one.Hash == 0 || one.Hash != dup.Hash {
+		t.Errorf("hashes of the duplicates = %x and %x, want the same non-zero hash", one.Hash, dup.Hash)
+	}
+	if other := result.FilesMap["/c/d/other.png"]; other.Hash != 0 {
+		t.Errorf("file with a unique size was hashed: %x", other.Hash)
+	}
+	if size := result.FilesMap["/z/empty.jpg"].Size; size != 0 {
+		t.Errorf("size of the empty file = %d, want 0", size)
+	}
+
+	group := result.HashMap[dedupeKey{Hash: one.Hash}]
+	var paths []string
+	for _, file := range group {
+		paths = append(paths, file.RelativePath)
+	}
+	sort.Strings(paths)
+	if want := []string{"/a/b/one.jpg", "/x/y/copy.jpg"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("duplicate group = %v, want %v", paths, want)
+	}
+	if stats.DuplicateFiles != 1 {
+		t.Errorf("DuplicateFiles = %d, want 1", stats.DuplicateFiles)
+	}
+}
+
+func TestScanFilesystemSequentialDir(t *testing.T) {
+	silenceOutput(t)
+
+	dir := newTestMediaDir(t, map[string][]byte{
+		"a/a/1.jpg": []byte("same"),
+		"b/b/2.jpg": []byte("same"),
+		"c/c/3.jpg": []byte("diff"),
+	})
+
+	config := testScanConfig(dir, 4)
+	config.HashStrategy = "sequential-dir"
+	config.WalkerCount = 1
+	stats := &Stats{}
+	result := scanFilesystem(config, stats)
+
+	if len(result.FilesMap) != 3 {
+		t.Fatalf("FilesMap has %d files, want 3", len(result.FilesMap))
+	}
+	if stats.HashedFiles != 3 || stats.DuplicateFiles != 1 {
+		t.Errorf("HashedFiles = %d, DuplicateFiles = %d, want 3 and 1", stats.HashedFiles, stats.DuplicateFiles)
+	}
+}
+
+func TestRunMockDB(t *testing.T) {
+	silenceOutput(t)
+
+	duplicate := append(append([]byte{}, jpegHeader...), "same"...)
+	dir := newTestMediaDir(t, map[string][]byte{
+		"a/b/used.jpg":      duplicate,
+		"a/b/copy.jpg":      duplicate,
+		"u/n/unused.png":    append(append([]byte{}, pngHeader...), "unused"...),
+		"cache/0123/u.jpg":  duplicate,
+		"a/b/.DS_Store":     []byte("metadata"),
+		"a/b/unrelated.txt": []byte("text"),
+	})
+
+	seed := filepath.Join(t.TempDir(), "gallery.txt")
+	if err := os.WriteFile(seed, []byte("/a/b/used.jpg\n/a/b/copy.jpg\n/m/i/missing.jpg\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out, errOut bytes.Buffer
+	code := Run([]string{"--mock-db", seed, "--media-path", dir, "--count-only"}, &out, &errOut)
+	if code != 0 {
+		t.Fatalf("Run returned %d, output:\n%s%s", code, out.String(), errOut.String())
+	}
+
+	want := "unused=1 missing=1 duplicates=1 db_entries=3 total_files=3"
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("output does not contain %q:\n%s", want, out.String())
+	}
+}
+
+func TestRunMockDBMaxDepth(t *testing.T) {
+	silenceOutput(t)
+
+	dir := newTestMediaDir(t, map[string][]byte{
+		"a/b/used.jpg": append(append([]byte{}, jpegHeader...), "used"...),
+	})
+
+	seed := filepath.Join(t.TempDir(), "gallery.txt")
+	if err := os.WriteFile(seed, []byte("/a/b/used.jpg\n/missing.jpg\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// /a/b/ is not scanned, only the missing file in the media path itself
+	// may be removed
+	var out, errOut bytes.Buffer
+	code := Run([]string{"--mock-db", seed, "--media-path", dir, "--max-depth", "1", "--remove-orphans"}, &out, &errOut)
+	if code != 0 {
+		t.Fatalf("Run returned %d, output:\n%s%s", code, out.String(), errOut.String())
+	}
+
+	for _, want := range []string{"Missing files: 1\n", "Removed orphaned rows: 1\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestRunMaxUnusedRatio(t *testing.T) {
+	silenceOutput(t)
+
+	// 21 of 26 files are unused, 80.8% must not pass --max-unused-ratio 80
+	files := make(map[string][]byte)
+	var gallery strings.Builder
+	for i := 0; i < 26; i++ {
+		path := fmt.Sprintf("a/b/%02d.jpg", i)
+		files[path] = append(append([]byte{}, jpegHeader...), byte(i))
+		if i < 5 {
+			gallery.WriteString("/" + path + "\n")
+		}
+	}
+	dir := newTestMediaDir(t, files)
+
+	seed := filepath.Join(t.TempDir(), "gallery.txt")
+	if err := os.WriteFile(seed, []byte(gallery.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out, errOut bytes.Buffer
+	code := Run([]string{"--mock-db", seed, "--media-path", dir, "--remove-unused", "--max-unused-ratio", "80"}, &out, &errOut)
+	if code != 1 {
+		t.Errorf("Run returned %d, want 1, output:\n%s%s", code, out.String(), errOut.String())
+	}
+	if want := "80.8% of files are unused"; !strings.Contains(out.String(), want) {
+		t.Errorf("output does not contain %q:\n%s", want, out.String())
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "a", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 26 {
+		t.Errorf("%d of 26 files left after the refused removal", len(entries))
+	}
+}
+
+func TestRunTopLargestUnused(t *testing.T) {
+	silenceOutput(t)
+
+	dir := newTestMediaDir(t, map[string][]byte{
+		"a/b/used.jpg":   append(append([]byte{}, jpegHeader...), "used"...),
+		"s/m/small.jpg":  append(append([]byte{}, jpegHeader...), "s"...),
+		"l/a/large.jpg":  append(append([]byte{}, jpegHeader...), strings.Repeat("l", 100)...),
+		"m/e/medium.jpg": append(append([]byte{}, jpegHeader...), strings.Repeat("m", 10)...),
+	})
+	seed := filepath.Join(t.TempDir(), "gallery.txt")
+	if err := os.WriteFile(seed, []byte("/a/b/used.jpg\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"/l/a/large.jpg", "/m/e/medium.jpg", "/s/m/small.jpg"}},
+		{[]string{"--report-top-N-largest-unused", "2"}, []string{"/l/a/large.jpg", "/m/e/medium.jpg"}},
+		{[]string{"--report-top-N-largest-unused", "0"}, nil},
+	} {
+		var out, errOut bytes.Buffer
+		args := append([]string{"--mock-db", seed, "--media-path", dir}, tc.args...)
+		if code := Run(args, &out, &errOut); code != 0 {
+			t.Fatalf("Run(%v) returned %d, output:\n%s%s", tc.args, code, out.String(), errOut.String())
+		}
+
+		var got []string
+		// The heading is followed by the PATH SIZE MODIFIED table header
+		_, report, found := strings.Cut(out.String(), " unused files:\n")
+		if found {
+			for _, line := range strings.Split(report, "\n")[1:] {
+				if !strings.HasPrefix(line, "/") {
+					break
+				}
+				got = append(got, strings.Fields(line)[0])
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Run(%v) listed %v, want %v:\n%s", tc.args, got, tc.want, out.String())
+		}
+	}
+}
+
+func TestRunUnreadableDirectoryStopsRemoval(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read every directory")
+	}
+	silenceOutput(t)
+
+	dir := newTestMediaDir(t, map[string][]byte{
+		"a/b/unused.jpg": append(append([]byte{}, jpegHeader...), "unused"...),
+		"c/d/used.jpg":   append(append([]byte{}, jpegHeader...), "used"...),
+	})
+	locked := filepath.Join(dir, "c", "d")
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(locked, 0o755) })
+
+	seed := filepath.Join(t.TempDir(), "gallery.txt")
+	if err := os.WriteFile(seed, []byte("/c/d/used.jpg\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out, errOut bytes.Buffer
+	code := Run([]string{"--mock-db", seed, "--media-path", dir, "--remove-unused"}, &out, &errOut)
+	if code != 1 {
+		t.Errorf("Run returned %d, want 1, output:\n%s%s", code, out.String(), errOut.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", "b", "unused.jpg")); err != nil {
+		t.Errorf("unused file was removed after the failed scan: %v", err)
+	}
+}
+
+// The cutoff driver returns one gallery value and then fails, like a result
+// cut off by --db-read-timeout
+var errCutOff = errors.New("i/o timeout")
+
+func init() {
+	sql.Register("cutoffdb", cutoffDriver{})
+}
+
+type cutoffDriver struct{}
+
+func (cutoffDriver) Open(string) (driver.Conn, error) { return cutoffConn{}, nil }
+
+type cutoffConn struct{}
+
+func (cutoffConn) Prepare(string) (driver.Stmt, error) { return cutoffStmt{}, nil }
+func (cutoffConn) Close() error                        { return nil }
+func (cutoffConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+type cutoffStmt struct{}
+
+func (cutoffStmt) Close() error                               { return nil }
+func (cutoffStmt) NumInput() int                              { return -1 }
+func (cutoffStmt) Exec([]driver.Value) (driver.Result, error) { return driver.RowsAffected(0), nil }
+func (cutoffStmt) Query([]driver.Value) (driver.Rows, error)  { return &cutoffRows{}, nil }
+
+type cutoffRows struct{ sent bool }
+
+func (r *cutoffRows) Columns() []string { return []string{"value"} }
+func (r *cutoffRows) Close() error      { return nil }
+func (r *cutoffRows) Next(dest []driver.Value) error {
+	if r.sent {
+		return errCutOff
+	}
+	r.sent = true
+	dest[0] = "/a/b/first.jpg"
+	return nil
+}
+
+func TestGetGalleryValuesCutOff(t *testing.T) {
+	db, err := sql.Open("cutoffdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	paths, err := getGalleryValues(db, Config{}, &Stats{})
+	if !errors.Is(err, errCutOff) {
+		t.Fatalf("getGalleryValues returned %v, %v, want the read error", paths, err)
+	}
+}
+
+var hashBenchmarkSizes = []struct {
+	name string
+	size int64
+}{
+	{"1KB", 1 << 10},
+	{"64KB", 64 << 10},
+	{"1MB", 1 << 20},
+	{"4MB", 4 << 20},
+	{"16MB", 16 << 20},
+	{"64MB", 64 << 20},
+}
+
+// writeBenchmarkFile writes size pseudo random bytes to a file in dir
+func writeBenchmarkFile(b *testing.B, dir string, size int64) string {
+	b.Helper()
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i>>8)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("bench-%d.jpg", size))
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+// BenchmarkHashFile hashes files through the mmap path (files below the
+// --mmap-threshold, Linux only) and the streaming path (threshold 0). Only
+// the first hashLimit bytes are hashed, the throughput is reported for those.
+func BenchmarkHashFile(b *testing.B) {
+	dir := b.TempDir()
+	for _, tc := range hashBenchmarkSizes {
+		path := writeBenchmarkFile(b, dir, tc.size)
+		hashed := min(tc.size, hashLimit)
+
+		for _, mode := range []struct {
+			name      string
+			threshold int64
+		}{
+			{"mmap", tc.size + 1},
+			{"stream", 0},
+		} {
+			b.Run(tc.name+"/"+mode.name, func(b *testing.B) {
+				b.SetBytes(hashed)
+				for i := 0; i < b.N; i++ {
+					if _, err := hashFile(path, mode.threshold); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkHashAlgorithm compares xxhash with SHA-256 on the bytes hashFile
+// reads, without the file I/O
+func BenchmarkHashAlgorithm(b *testing.B) {
+	for _, tc := range hashBenchmarkSizes {
+		data := make([]byte, min(tc.size, hashLimit))
+		b.Run(tc.name+"/xxhash", func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				xxhash.Sum64(data)
+			}
+		})
+		b.Run(tc.name+"/sha256", func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				sha256.Sum256(data)
+			}
+		})
+	}
+}
+
+// BenchmarkScanFilesystem scans 10,000 files in the /x/y/ layout, every
+// tenth of them with a duplicate, with different worker counts
+func BenchmarkScanFilesystem(b *testing.B) {
+	silenceOutput(b)
+
+	dir := b.TempDir()
+	const fileCount = 10000
+	for i := 0; i < fileCount; i++ {
+		content := fmt.Sprintf("image %d", i)
+		if i%10 == 1 {
+			content = fmt.Sprintf("image %d", i-1)
+		}
+		rel := fmt.Sprintf("%c/%c/image-%d.jpg", 'a'+i%26, 'a'+i/26%26, i)
+		writeTestFiles(b, dir, map[string][]byte{rel: []byte(content)})
+	}
+
+	for _, workers := range []int{1, 4, 10, 20} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			config := testScanConfig(dir, workers)
+			for i := 0; i < b.N; i++ {
+				result := scanFilesystem(config, &Stats{})
+				if len(result.FilesMap) != fileCount {
+					b.Fatalf("scanned %d files, want %d", len(result.FilesMap), fileCount)
+				}
+			}
+		})
+	}
+}
+
+func TestParseEnvPHP(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		connection string
+		want       map[string]string
+		wantErr    bool
+	}{
+		{
+			name: "standard",
+			content: `<?php
+return [
+    'backend' => ['frontName' => 'admin'],
+    'db' => [
+        'table_prefix' => 'mage_',
+        'connection' => [
+            'default' => [
+                'host' => 'localhost',
+                'dbname' => 'magento',
+                'username' => 'magento',
+                'password' => 'secret',
+                'model' => 'mysql4',
+                'engine' => 'innodb',
+                'active' => '1',
+            ],
+        ],
+    ],
+];`,
+			want: map[string]string{"table_prefix": "mage_", "host": "localhost", "dbname": "magento", "username": "magento", "password": "secret"},
+		},
+		{
+			name: "cloud with comments",
+			content: `<?php
+// Generated by ece-tools
+return [
+    'db' => [
+        # 'table_prefix' => 'old_',
+        'table_prefix' => '',
+        'connection' => [
+            /* 'default' => [
+                'host' => 'commented.example.com',
+            ], */
+            'default' => [
+                'host' => 'database.internal', // primary
+                'dbname' => 'main',
+                'username' => 'user',
+                'password' => '',
+            ],
+        ],
+    ],
+];`,
+			want: map[string]string{"table_prefix": "", "host": "database.internal", "dbname": "main", "username": "user", "password": ""},
+		},
+		{
+			name: "array syntax and port in host",
+			content: `<?php
+return array(
+    'db' => array(
+        'table_prefix' => 'm2_',
+        'connection' => array(
+            'default' => array(
+                'host' => 'db:3307',
+                'dbname' => 'shop',
+                'username' => 'shop',
+                'password' => 'p(ass)',
+            ),
+        ),
+    ),
+);`,
+			want: map[string]string{"table_prefix": "m2_", "host": "db:3307", "dbname": "shop", "username": "shop", "password": "p(ass)"},
+		},
+		{
+			name: "double quoted values",
+			content: `<?php
+return [
+    "db" => [
+        "table_prefix" => "",
+        "connection" => [
+            "default" => [
+                "host" => "localhost:/var/run/mysqld/mysqld.sock",
+                "dbname" => "magento",
+                "username" => "root",
+                "password" => "a\"b\\c\$d#e",
+            ],
+        ],
+    ],
+];`,
+			want: map[string]string{"table_prefix": "", "host": "localhost:/var/run/mysqld/mysqld.sock", "dbname": "magento", "username": "root", "password": `a"b\c$d#e`},
+		},
+		{
+			name: "special characters in password",
+			content: `<?php
+return [
+    'db' => [
+        'connection' => [
+            'default' => [
+                'host' => 'localhost',
+                'dbname' => 'magento',
+                'username' => 'magento',
+                'password' => 'it\'s@a\\pass/*word]',
+            ],
+        ],
+    ],
+];`,
+			want: map[string]string{"table_prefix": "", "host": "localhost", "dbname": "magento", "username": "magento", "password": `it's@a\pass/*word]`},
+		},
+		{
+			name:       "named connection",
+			connection: "indexer",
+			content: `<?php
+return [
+    'db' => [
+        'connection' => [
+            'default' => ['host' => 'primary', 'dbname' => 'main', 'username' => 'u', 'password' => 'p'],
+            'indexer' => ['host' => 'replica', 'dbname' => 'idx', 'username' => 'i', 'password' => 'q'],
+        ],
+    ],
+];`,
+			want: map[string]string{"table_prefix": "", "host": "replica", "dbname": "idx", "username": "i", "password": "q"},
+		},
+		{
+			name:       "missing connection",
+			connection: "checkout",
+			content:    `<?php return ['db' => ['connection' => ['default' => ['host' => 'localhost']]]];`,
+			wantErr:    true,
+		},
+		{
+			name:    "missing db section",
+			content: `<?php return ['backend' => ['frontName' => 'admin']];`,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			connection := tc.connection
+			if connection == "" {
+				connection = "default"
+			}
+			result, err := parseEnvPHPContent(tc.content, connection)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, want := range tc.want {
+				if got := result[key]; got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSanitizeTablePrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"mage_", "mage_"},
+		{"", ""},
+		{"m2_store_1_", "m2_store_1_"},
+		{"'; DROP TABLE users; --", "DROPTABLEusers"},
+		{"prefix`.`admin_user", "prefixadmin_user"},
+		{"préfixe_", "prfixe_"},
+		{"表_", "_"},
+		{"a b\tc\n", "abc"},
+	}
+
+	for _, tc := range tests {
+		if got := sanitizeTablePrefix(tc.prefix); got != tc.want {
+			t.Errorf("sanitizeTablePrefix(%q) = %q, want %q", tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func FuzzSanitizeTablePrefix(f *testing.F) {
+	for _, seed := range []string{"mage_", "", "'; DROP TABLE users; --", "préfixe_", "`x`", "\x00_"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, prefix string) {
+		got := sanitizeTablePrefix(prefix)
+		for i := 0; i < len(got); i++ {
+			c := got[i]
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+				t.Fatalf("sanitizeTablePrefix(%q) = %q contains %q", prefix, got, c)
+			}
+		}
+		if sanitizeTablePrefix(got) != got {
+			t.Fatalf("sanitizeTablePrefix(%q) = %q is not stable", prefix, got)
+		}
+	})
+}
+
+func TestBuildBatchUpdateSQL(t *testing.T) {
+	mappings := []DuplicateMapping{
+		{Original: "/a/b/keep.jpg", Duplicate: "/a/b/keep_1.jpg"},
+		{Original: "/c/d/o'brien.jpg", Duplicate: "/c/d/o'brien_1.jpg"},
+	}
+
+	tests := []struct {
+		name      string
+		collation string
+		want      string
+	}{
+		{
+			name: "without collation",
+			want: "UPDATE m2_gallery SET value = CASE value WHEN ? THEN ? WHEN ? THEN ? END WHERE value IN (?, ?)",
+		},
+		{
+			name:      "with collation",
+			collation: "utf8mb4_bin",
+			want:      "UPDATE m2_gallery SET value = CASE value COLLATE utf8mb4_bin WHEN ? THEN ? WHEN ? THEN ? END WHERE value COLLATE utf8mb4_bin IN (?, ?)",
+		},
+	}
+
+	// The CASE pairs come first, the IN list after all of them
+	wantArgs := []interface{}{
+		"/a/b/keep_1.jpg", "/a/b/keep.jpg",
+		"/c/d/o'brien_1.jpg", "/c/d/o'brien.jpg",
+		"/a/b/keep_1.jpg", "/c/d/o'brien_1.jpg",
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			query, args := buildBatchUpdateSQL("m2_gallery", mappings, Config{DBCollation: tc.collation})
+			if query != tc.want {
+				t.Errorf("query =\n%s\nwant\n%s", query, tc.want)
+			}
+			if !reflect.DeepEqual(args, wantArgs) {
+				t.Errorf("args = %q, want %q", args, wantArgs)
+			}
+			if strings.Contains(query, "'") {
+				t.Errorf("path values are in the query instead of the arguments: %s", query)
+			}
+		})
+	}
+}
+
+func TestBuildBatchUpdateSQLFullBatch(t *testing.T) {
+	const batchSize = 5000
+	mappings := make([]DuplicateMapping, batchSize)
+	for i := range mappings {
+		mappings[i] = DuplicateMapping{Original: fmt.Sprintf("/o/r/%d.jpg", i), Duplicate: fmt.Sprintf("/d/u/%d.jpg", i)}
+	}
+
+	for _, collation := range []string{"", "utf8mb4_general_ci"} {
+		query, args := buildBatchUpdateSQL("catalog_product_entity_media_gallery", mappings, Config{DBCollation: collation})
+
+		if got := strings.Count(query, "WHEN ? THEN ?"); got != batchSize {
+			t.Errorf("collation %q: %d WHEN clauses, want %d", collation, got, batchSize)
+		}
+		if got := strings.Count(query, "?"); got != 3*batchSize {
+			t.Errorf("collation %q: %d placeholders, want %d", collation, got, 3*batchSize)
+		}
+		if len(args) != 3*batchSize {
+			t.Fatalf("collation %q: %d args, want %d", collation, len(args), 3*batchSize)
+		}
+		for i, mapping := range mappings {
+			if args[2*i] != mapping.Duplicate || args[2*i+1] != mapping.Original || args[2*batchSize+i] != mapping.Duplicate {
+				t.Fatalf("collation %q: args of mapping %d are out of order", collation, i)
+			}
+		}
+	}
+}
+
+func BenchmarkBuildBatchUpdateSQL(b *testing.B) {
+	for _, size := range []int{100, 1000, 5000, 10000} {
+		mappings := make([]DuplicateMapping, size)
+		for i := range mappings {
+			mappings[i] = DuplicateMapping{Original: fmt.Sprintf("/o/r/original-%d.jpg", i), Duplicate: fmt.Sprintf("/d/u/duplicate-%d.jpg", i)}
+		}
+		b.Run(fmt.Sprintf("mappings=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buildBatchUpdateSQL("catalog_product_entity_media_gallery", mappings, Config{})
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The mock database driver backs --mock-db. It keeps the values of
+// catalog_product_entity_media_gallery in memory, seeded from a file with one
+// path per line, and understands the statements issued by
+// getMediaGalleryPaths, removeOrphanedRows and updateDatabaseForDuplicatesBatch.
+// Any other query returns no rows and any other statement affects no rows.
+
+func init() {
+	sql.Register("mockdb", &mockDriver{})
+}
+
+// openMockDB opens a mock database seeded with the gallery paths in seedFile
+func openMockDB(seedFile string) (*sql.DB, error) {
+	f, err := os.Open(seedFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	store := &mockStore{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		store.gallery = append(store.gallery, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	mockStoresMu.Lock()
+	mockStores[seedFile] = store
+	mockStoresMu.Unlock()
+
+	return sql.Open("mockdb", seedFile)
+}
+
+var (
+	mockStoresMu sync.Mutex
+	mockStores   = make(map[string]*mockStore)
+)
+
+// mockStore is the in-memory table content shared by all connections
+type mockStore struct {
+	mu      sync.Mutex
+	gallery []string
+}
+
+type mockDriver struct{}
+
+func (d *mockDriver) Open(name string) (driver.Conn, error) {
+	mockStoresMu.Lock()
+	defer mockStoresMu.Unlock()
+
+	store, ok := mockStores[name]
+	if !ok {
+		return nil, fmt.Errorf("mockdb: unknown database %q", name)
+	}
+	return &mockConn{store: store}, nil
+}
+
+type mockConn struct {
+	store *mockStore
+}
+
+func (c *mockConn) Prepare(query string) (driver.Stmt, error) {
+	return &mockStmt{store: c.store, query: query}, nil
+}
+
+func (c *mockConn) Close() error {
+	return nil
+}
+
+func (c *mockConn) Begin() (driver.Tx, error) {
+	return mockTx{}, nil
+}
+
+// mockTx applies statements immediately, rollback is not supported
+type mockTx struct{}
+
+func (mockTx) Commit() error   { return nil }
+func (mockTx) Rollback() error { return nil }
+
+type mockStmt struct {
+	store *mockStore
+	query string
+}
+
+func (s *mockStmt) Close() error {
+	return nil
+}
+
+func (s *mockStmt) NumInput() int {
+	return -1
+}
+
+func (s *mockStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	if !mockTargetsGallery(s.query) {
+		return driver.RowsAffected(0), nil
+	}
+
+	switch {
+	case strings.HasPrefix(s.query, "DELETE FROM "):
+		remove := make(map[string]bool, len(args))
+		for _, arg := range args {
+			remove[fmt.Sprint(arg)] = true
+		}
+		return driver.RowsAffected(s.store.filter(func(value string) bool { return !remove[value] })), nil
+
+	case strings.HasPrefix(s.query, "UPDATE "):
+		// CASE value WHEN ? THEN ? ... END WHERE value IN (?, ...)
+		pairs := strings.Count(s.query, "WHEN ?")
+		if len(args) < pairs*2 {
+			return nil, fmt.Errorf("mockdb: expected at least %d arguments, got %d", pairs*2, len(args))
+		}
+		replace := make(map[string]string, pairs)
+		for i := 0; i < pairs; i++ {
+			from := fmt.Sprint(args[i*2])
+			if _, seen := replace[from]; !seen {
+				replace[from] = fmt.Sprint(args[i*2+1])
+			}
+		}
+		where := make(map[string]bool, len(args)-pairs*2)
+		for _, arg := range args[pairs*2:] {
+			where[fmt.Sprint(arg)] = true
+		}
+
+		var affected int64
+		for i, value := range s.store.gallery {
+			if to, ok := replace[value]; ok && where[value] && to != value {
+				s.store.gallery[i] = to
+				affected++
+			}
+		}
+		return driver.RowsAffected(affected), nil
+	}
+
+	return driver.RowsAffected(0), nil
+}
+
+func (s *mockStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	rows := &mockRows{columns: []string{"value"}}
+	if !strings.HasPrefix(s.query, "SELECT value FROM ") || !mockTargetsGallery(s.query) {
+		return rows, nil
+	}
+
+	prefix := ""
+	if strings.Contains(s.query, "LIKE ?") && len(args) > 0 {
+		prefix = unescapeLike(strings.TrimSuffix(fmt.Sprint(args[0]), "%"))
+	}
+	for _, value := range s.store.gallery {
+		if strings.HasPrefix(value, prefix) {
+			rows.values = append(rows.values, value)
+		}
+	}
+	return rows, nil
+}
+
+// filter keeps the gallery values for which keep returns true and returns
+// the number of removed values
+func (m *mockStore) filter(keep func(value string) bool) int64 {
+	kept := m.gallery[:0]
+	for _, value := range m.gallery {
+		if keep(value) {
+			kept = append(kept, value)
+		}
+	}
+	removed := int64(len(m.gallery) - len(kept))
+	m.gallery = kept
+	return removed
+}
+
+// mockTargetsGallery reports whether the statement operates on the media
+// gallery table itself (not its _value or _value_to_entity tables)
+func mockTargetsGallery(query string) bool {
+	fields := strings.Fields(query)
+	for i, field := range fields {
+		if (field == "FROM" || field == "UPDATE") && i+1 < len(fields) {
+			return strings.HasSuffix(fields[i+1], "catalog_product_entity_media_gallery")
+		}
+	}
+	return false
+}
+
+// unescapeLike reverses escapeLike
+func unescapeLike(s string) string {
+	return strings.NewReplacer(`\%`, "%", `\_`, "_", `\\`, `\`).Replace(s)
+}
+
+type mockRows struct {
+	columns []string
+	values  []string
+	pos     int
+}
+
+func (r *mockRows) Columns() []string {
+	return r.columns
+}
+
+func (r *mockRows) Close() error {
+	return nil
+}
+
+func (r *mockRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.values) {
+		return io.EOF
+	}
+	dest[0] = r.values[r.pos]
+	r.pos++
+	return nil
+}
@@ -0,0 +1,45 @@
+//go:build profile
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// profilingSupported reports whether --profile-cpu and --profile-mem work in
+// this build, they need the profile build tag
+const profilingSupported = true
+
+// startCPUProfile writes a CPU profile to path until the returned function
+// is called
+func startCPUProfile(path string) (func(), error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		pprof.StopCPUProfile()
+		f.Close()
+	}, nil
+}
+
+// writeHeapProfile writes the current heap profile to path
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	// Up-to-date statistics of all allocations so far
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
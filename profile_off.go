@@ -0,0 +1,19 @@
+//go:build !profile
+
+package main
+
+import "errors"
+
+// profilingSupported is false in normal builds, runtime/pprof is only linked
+// with the profile build tag
+const profilingSupported = false
+
+var errNoProfiling = errors.New("profiling is not supported by this build, rebuild with -tags profile")
+
+func startCPUProfile(path string) (func(), error) {
+	return nil, errNoProfiling
+}
+
+func writeHeapProfile(path string) error {
+	return errNoProfiling
+}